@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const addrFile = "peers_%s.dat"
+const maxAddrPerMsg = 1000
+const maxAddrFailures = 10
+const addrRetryDelay = time.Minute
+const maxAddrRetryDelay = time.Hour
+const addrHorizon = 7 * 24 * time.Hour
+
+// maxKnownAddrs bounds the address table. Once it is full, the address
+// seen longest ago makes room for a new one.
+var maxKnownAddrs = 5000
+
+// KnownAddress is what the node remembers about a peer address.
+type KnownAddress struct {
+	Addr        string
+	LastSeen    time.Time
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Successes   int
+	Failures    int
+}
+
+// isGood reports whether the address is worth telling other peers about:
+// it has been seen lately and is not failing.
+func (ka *KnownAddress) isGood(now time.Time) bool {
+	return ka.Failures < 3 && now.Sub(ka.LastSeen) < addrHorizon
+}
+
+// retryAt is when a failing address may be dialled again. The delay grows
+// with every failure in a row.
+func (ka *KnownAddress) retryAt() time.Time {
+	if ka.Failures == 0 {
+		return ka.LastAttempt
+	}
+
+	delay := addrRetryDelay << uint(ka.Failures-1)
+	if delay > maxAddrRetryDelay || delay <= 0 {
+		delay = maxAddrRetryDelay
+	}
+
+	return ka.LastAttempt.Add(delay)
+}
+
+// AddrManager keeps the addresses of the nodes this node has heard of and
+// how connecting to them went. If it has a file, Save writes it there.
+type AddrManager struct {
+	mu    sync.Mutex
+	file  string
+	dirty bool
+	Addrs map[string]*KnownAddress
+}
+
+// NewAddrManager returns an empty address manager kept in memory only.
+func NewAddrManager() *AddrManager {
+	return &AddrManager{Addrs: make(map[string]*KnownAddress)}
+}
+
+// LoadAddrManager reads the addresses known to node nodeID.
+func LoadAddrManager(nodeID string) (*AddrManager, error) {
+	return loadAddrManagerFile(fmt.Sprintf(addrFile, nodeID))
+}
+
+func loadAddrManagerFile(file string) (*AddrManager, error) {
+	am := NewAddrManager()
+	am.file = file
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return am, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(am)
+	if err != nil {
+		return nil, err
+	}
+
+	return am, nil
+}
+
+// Add remembers addresses heard of at now and returns how many were new.
+// Hearing of a known address again does not make it look any fresher.
+func (am *AddrManager) Add(addrs []string, now time.Time) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if am.Addrs[addr] == nil && am.insert(addr, now) != nil {
+			added++
+		}
+	}
+
+	return added
+}
+
+// insert adds addr, first seen at now, unless it is not a valid host:port.
+// If the table is full the address seen longest ago is dropped for it.
+func (am *AddrManager) insert(addr string, now time.Time) *KnownAddress {
+	if !validAddr(addr) {
+		return nil
+	}
+
+	if len(am.Addrs) >= maxKnownAddrs {
+		var oldest *KnownAddress
+		for _, ka := range am.Addrs {
+			if oldest == nil || ka.LastSeen.Before(oldest.LastSeen) {
+				oldest = ka
+			}
+		}
+		delete(am.Addrs, oldest.Addr)
+	}
+
+	ka := &KnownAddress{Addr: addr, LastSeen: now}
+	am.Addrs[addr] = ka
+	am.dirty = true
+
+	return ka
+}
+
+// validAddr reports whether addr is a host and a port number.
+func validAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+
+	return err == nil && n > 0 && n <= 65535
+}
+
+// Attempt records that addr is being dialled.
+func (am *AddrManager) Attempt(addr string, now time.Time) {
+	am.update(addr, func(ka *KnownAddress) {
+		ka.LastAttempt = now
+	})
+}
+
+// Good records a successful connection to addr.
+func (am *AddrManager) Good(addr string, now time.Time) {
+	am.update(addr, func(ka *KnownAddress) {
+		ka.LastSeen = now
+		ka.LastSuccess = now
+		ka.Successes++
+		ka.Failures = 0
+	})
+}
+
+// Failed records a failed connection to addr. Addresses that keep failing
+// and have not worked for a long time are forgotten.
+func (am *AddrManager) Failed(addr string, now time.Time) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	ka := am.Addrs[addr]
+	if ka == nil {
+		return
+	}
+	ka.Failures++
+	am.dirty = true
+
+	if ka.Failures >= maxAddrFailures && now.Sub(ka.LastSuccess) > addrHorizon {
+		delete(am.Addrs, addr)
+	}
+}
+
+// Seen records that a peer at addr was connected until now.
+func (am *AddrManager) Seen(addr string, now time.Time) {
+	am.update(addr, func(ka *KnownAddress) {
+		ka.LastSeen = now
+	})
+}
+
+func (am *AddrManager) Remove(addr string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	delete(am.Addrs, addr)
+	am.dirty = true
+}
+
+func (am *AddrManager) update(addr string, f func(ka *KnownAddress)) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	ka := am.Addrs[addr]
+	if ka == nil {
+		ka = am.insert(addr, time.Time{})
+		if ka == nil {
+			return
+		}
+	}
+	f(ka)
+	am.dirty = true
+}
+
+func (am *AddrManager) Get(addr string) (KnownAddress, bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	ka := am.Addrs[addr]
+	if ka == nil {
+		return KnownAddress{}, false
+	}
+
+	return *ka, true
+}
+
+// Addresses lists every known address, sorted.
+func (am *AddrManager) Addresses() []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var addrs []string
+	for addr := range am.Addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+func (am *AddrManager) Count() int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	return len(am.Addrs)
+}
+
+// Select picks an address to dial that is not in exclude and is not
+// waiting out a failure. Addresses that failed less are more likely to be
+// picked. It returns false if there is no candidate.
+func (am *AddrManager) Select(exclude map[string]bool, now time.Time) (string, bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var candidates []*KnownAddress
+	total := 0.0
+	for _, ka := range am.Addrs {
+		if exclude[ka.Addr] || now.Before(ka.retryAt()) {
+			continue
+		}
+		candidates = append(candidates, ka)
+		total += 1 / float64(1+ka.Failures)
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	// Map iteration order differs between calls, so sort for a pick that
+	// only depends on the random number.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Addr < candidates[j].Addr
+	})
+
+	r := rand.Float64() * total
+	for _, ka := range candidates {
+		r -= 1 / float64(1+ka.Failures)
+		if r < 0 {
+			return ka.Addr, true
+		}
+	}
+
+	return candidates[len(candidates)-1].Addr, true
+}
+
+// Sample returns up to n good addresses in random order.
+func (am *AddrManager) Sample(n int, now time.Time) []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var good []string
+	for addr, ka := range am.Addrs {
+		if ka.isGood(now) {
+			good = append(good, addr)
+		}
+	}
+
+	rand.Shuffle(len(good), func(i, j int) {
+		good[i], good[j] = good[j], good[i]
+	})
+	if len(good) > n {
+		good = good[:n]
+	}
+
+	return good
+}
+
+// Save writes the addresses to the manager's file if they changed.
+func (am *AddrManager) Save() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.file == "" || !am.dirty {
+		return
+	}
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(am)
+	if err == nil {
+		err = ioutil.WriteFile(am.file, content.Bytes(), 0644)
+	}
+	if err != nil {
+		fmt.Printf("Saving peer addresses failed: %s\n", err)
+		return
+	}
+	am.dirty = false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrManagerAdd(t *testing.T) {
+	am := NewAddrManager()
+	now := time.Now()
+
+	assert.Equal(t, 2, am.Add([]string{"a:1", "b:1", ""}, now))
+	assert.Equal(t, 1, am.Add([]string{"a:1", "c:1"}, now.Add(time.Hour)))
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, am.Addresses())
+
+	ka, _ := am.Get("a:1")
+	assert.Equal(t, now, ka.LastSeen, "Hearing of an address again does not refresh it")
+
+	assert.Zero(t, am.Add([]string{"d", "d:", ":1", "d:0", "d:65536", "d:port", "not an address"}, now))
+	am.Seen("e", now)
+	assert.Equal(t, 3, am.Count(), "Only host:port addresses are kept")
+}
+
+func TestAddrManagerEvictsOldestWhenFull(t *testing.T) {
+	defer func(limit int) { maxKnownAddrs = limit }(maxKnownAddrs)
+	maxKnownAddrs = 2
+
+	am := NewAddrManager()
+	now := time.Now()
+	am.Add([]string{"a:1"}, now.Add(-time.Hour))
+	am.Add([]string{"b:1"}, now)
+
+	assert.Equal(t, 1, am.Add([]string{"c:1"}, now))
+	assert.Equal(t, []string{"b:1", "c:1"}, am.Addresses())
+}
+
+func TestAddrManagerSelectBacksOffFailures(t *testing.T) {
+	am := NewAddrManager()
+	now := time.Now()
+	am.Add([]string{"a:1"}, now)
+
+	am.Attempt("a:1", now)
+	am.Failed("a:1", now)
+	_, ok := am.Select(nil, now.Add(addrRetryDelay/2))
+	assert.False(t, ok, "Failed address is retried too soon")
+
+	addr, ok := am.Select(nil, now.Add(addrRetryDelay))
+	assert.True(t, ok)
+	assert.Equal(t, "a:1", addr)
+
+	_, ok = am.Select(map[string]bool{"a:1": true}, now.Add(addrRetryDelay))
+	assert.False(t, ok)
+
+	am.Attempt("a:1", now)
+	am.Failed("a:1", now)
+	_, ok = am.Select(nil, now.Add(addrRetryDelay))
+	assert.False(t, ok, "Delay does not grow with failures")
+
+	am.Good("a:1", now)
+	_, ok = am.Select(nil, now)
+	assert.True(t, ok)
+}
+
+func TestAddrManagerForgetsDeadAddresses(t *testing.T) {
+	am := NewAddrManager()
+	now := time.Now()
+	am.Add([]string{"a:1"}, now)
+
+	for i := 0; i < maxAddrFailures; i++ {
+		am.Failed("a:1", now)
+	}
+	assert.Equal(t, 0, am.Count())
+}
+
+func TestAddrManagerSampleSkipsBadAddresses(t *testing.T) {
+	am := NewAddrManager()
+	now := time.Now()
+	am.Add([]string{"a:1", "b:1", "c:1"}, now)
+	am.Add([]string{"old:1"}, now.Add(-2*addrHorizon))
+	for i := 0; i < 3; i++ {
+		am.Failed("c:1", now)
+	}
+
+	assert.ElementsMatch(t, []string{"a:1", "b:1"}, am.Sample(10, now))
+	assert.Len(t, am.Sample(1, now), 1)
+}
+
+func TestAddrManagerPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peers.dat")
+	now := time.Now().Round(0)
+
+	am, err := loadAddrManagerFile(file)
+	assert.NoError(t, err)
+	am.Add([]string{"a:1", "b:1"}, now)
+	am.Good("a:1", now)
+	am.Save()
+
+	loaded, err := loadAddrManagerFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:1"}, loaded.Addresses())
+
+	ka, _ := loaded.Get("a:1")
+	assert.Equal(t, 1, ka.Successes)
+	assert.True(t, now.Equal(ka.LastSuccess))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const banListFile = "bans_%s.dat"
+const banThreshold = 100
+const defaultBanDuration = 24 * time.Hour
+
+// Misbehavior scores for protocol violations.
+const (
+	scoreBadFrame           = 100
+	scoreHandlerPanic       = 100
+	scoreInvalidBlock       = 100
+	scoreInvalidHeaders     = 100
+	scoreUnconnectedHeaders = 20
+	scoreMalformedMessage   = 20
+	scoreInvalidTx          = 10
+)
+
+// BanList holds the IP addresses peers may not connect from, or be
+// reached at, until a given time. Bans go by the IP address of the
+// connection rather than anything a peer claims about itself, so a peer
+// cannot dodge its ban or get another node banned. If the list has a file,
+// every change is written to it.
+type BanList struct {
+	mu   sync.Mutex
+	file string
+	Bans map[string]time.Time
+}
+
+// NewBanList returns an empty list that is only kept in memory.
+func NewBanList() *BanList {
+	return &BanList{Bans: make(map[string]time.Time)}
+}
+
+// LoadBanList reads the ban list of node nodeID, or starts an empty one if
+// there is none yet.
+func LoadBanList(nodeID string) (*BanList, error) {
+	return loadBanListFile(fmt.Sprintf(banListFile, nodeID))
+}
+
+func loadBanListFile(file string) (*BanList, error) {
+	bl := NewBanList()
+	bl.file = file
+
+	content, err := ioutil.ReadFile(bl.file)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(bl)
+	if err != nil {
+		return nil, err
+	}
+
+	return bl, nil
+}
+
+// Ban keeps address out until until.
+func (bl *BanList) Ban(address string, until time.Time) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.Bans[address] = until
+	bl.save()
+}
+
+func (bl *BanList) Unban(address string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	delete(bl.Bans, address)
+	bl.save()
+}
+
+func (bl *BanList) Clear() {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.Bans = make(map[string]time.Time)
+	bl.save()
+}
+
+func (bl *BanList) IsBanned(address string, now time.Time) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	until, ok := bl.Bans[address]
+
+	return ok && now.Before(until)
+}
+
+// Active returns the addresses still banned at now, sorted, and drops the
+// bans that have run out.
+func (bl *BanList) Active(now time.Time) []string {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	var addresses []string
+	expired := false
+	for address, until := range bl.Bans {
+		if now.Before(until) {
+			addresses = append(addresses, address)
+		} else {
+			delete(bl.Bans, address)
+			expired = true
+		}
+	}
+	if expired {
+		bl.save()
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// Until returns when the ban on address ends.
+func (bl *BanList) Until(address string) time.Time {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	return bl.Bans[address]
+}
+
+func (bl *BanList) save() {
+	if bl.file == "" {
+		return
+	}
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(bl)
+	if err == nil {
+		err = ioutil.WriteFile(bl.file, content.Bytes(), 0644)
+	}
+	if err != nil {
+		fmt.Printf("Saving ban list failed: %s\n", err)
+	}
+}
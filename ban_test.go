@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanListPersists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.dat")
+	now := time.Now()
+
+	bans, err := loadBanListFile(file)
+	assert.NoError(t, err)
+	bans.Ban("10.0.0.1", now.Add(time.Hour))
+	bans.Ban("10.0.0.2", now.Add(-time.Minute))
+	bans.Ban("10.0.0.3", now.Add(time.Hour))
+	bans.Unban("10.0.0.3")
+
+	bans, err = loadBanListFile(file)
+	assert.NoError(t, err)
+	assert.True(t, bans.IsBanned("10.0.0.1", now))
+	assert.False(t, bans.IsBanned("10.0.0.2", now), "Bans run out")
+	assert.Equal(t, []string{"10.0.0.1"}, bans.Active(now))
+
+	bans.Clear()
+	bans, err = loadBanListFile(file)
+	assert.NoError(t, err)
+	assert.Empty(t, bans.Active(now))
+}
+
+func TestMisbehavingPeerIsBanned(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	n := NewNode(Config{}, bc)
+	p, _ := testPeerPair(t)
+
+	for i := 0; i < banThreshold/scoreMalformedMessage-1; i++ {
+		n.handleMessage(p, &message{"inv", []byte("garbage")})
+	}
+	assert.False(t, n.bans.IsBanned("127.0.0.1", time.Now()))
+
+	n.handleMessage(p, &message{"inv", []byte("garbage")})
+	assert.True(t, n.bans.IsBanned("127.0.0.1", time.Now()))
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("Banned peer is still connected")
+	}
+}
+
+func TestInvalidBlockBansPeer(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	n := NewNode(Config{}, bc)
+	p, _ := testPeerPair(t)
+
+	bad := mineTestBlock(bc, bc.mustGetBlock(bc.tip), address)
+	bad.MerkleRoot = []byte("wrong")
+	bad.Mine(context.Background())
+
+	n.handleMessage(p, &message{"block", gobEncode(block{bad.Serialize()})})
+	assert.True(t, n.bans.IsBanned("127.0.0.1", time.Now()))
+}
+
+func TestBannedIPCannotConnect(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	a := startTestNode(t, bc)
+	b := startTestNode(t, newTestChainFrom(t, bc.mustGetBlock(bc.tip)))
+	a.bans.Ban("127.0.0.1", time.Now().Add(time.Hour))
+
+	// Connections from loopback are only refused after the handshake, in
+	// case they come from the command line.
+	b.Connect(a.address)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.peers.Count() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Inbound connections from a banned IP are refused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Zero(t, a.peers.Count())
+
+	a.Connect(b.address)
+	assert.Zero(t, a.peers.Count(), "Banned IPs are not dialled")
+}
+
+func TestSetBanChangesRunningNode(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	a := startTestNode(t, bc)
+	until := time.Now().Add(time.Hour)
+
+	bans, err := setBan(a.address, setban{"10.0.0.1", until})
+	assert.NoError(t, err)
+	assert.Contains(t, bans, "10.0.0.1")
+	assert.True(t, a.bans.IsBanned("10.0.0.1", time.Now()))
+
+	_, err = setBan(a.address, setban{"10.0.0.2", until})
+	assert.NoError(t, err)
+	bans, err = setBan(a.address, setban{"10.0.0.1", time.Time{}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, a.bans.Active(time.Now()))
+	assert.Len(t, bans, 1)
+
+	_, err = setBan(a.address, setban{})
+	assert.NoError(t, err)
+	assert.Empty(t, a.bans.Active(time.Now()))
+}
+
+func TestInvalidOrphanBansItsSender(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	n := NewNode(Config{}, bc)
+	sender, _ := testPeerPair(t)
+	other, _ := testPeerPair(t)
+
+	parent := mineTestBlock(bc, bc.mustGetBlock(bc.tip), address)
+	child := mineTestBlock(bc, parent, address)
+	child.Bits++
+	child.Mine(context.Background())
+
+	n.handleMessage(sender, &message{"block", gobEncode(block{child.Serialize()})})
+	assert.True(t, n.orphans.Has(child.Hash))
+
+	n.handleMessage(other, &message{"block", gobEncode(block{parent.Serialize()})})
+	select {
+	case <-sender.Done():
+	default:
+		t.Fatal("Sender of the invalid orphan is still connected")
+	}
+	select {
+	case <-other.Done():
+		t.Fatal("Sender of the valid parent was disconnected")
+	default:
+	}
+}
+
+func TestCommandLineOutlivesALoopbackBan(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	a := startTestNode(t, bc)
+
+	bans, err := setBan(a.address, setban{"127.0.0.1", time.Now().Add(time.Hour)})
+	assert.NoError(t, err, "The session that asked for the ban is kept")
+	assert.Contains(t, bans, "127.0.0.1")
+
+	_, err = queryPeerInfo(a.address)
+	assert.NoError(t, err, "The command line is let in despite the ban")
+
+	_, err = setBan(a.address, setban{})
+	assert.NoError(t, err)
+	assert.Empty(t, a.bans.Active(time.Now()))
+}
+
+func TestPeerNodesCannotChangeBans(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	n := NewNode(Config{}, bc)
+	n.bans.Ban("10.0.0.1", time.Now().Add(time.Hour))
+
+	_, p := testPeerPair(t)
+	p.version.AddrFrom = "127.0.0.1:3001"
+	n.handleMessage(p, &message{"setban", gobEncode(setban{})})
+	assert.True(t, n.bans.IsBanned("10.0.0.1", time.Now()))
+}
+
+func TestMisbehavingCommandLineIsNotBanned(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	n := NewNode(Config{}, bc)
+	_, p := testPeerPair(t)
+
+	n.misbehaving(p, banThreshold, "test")
+	assert.False(t, n.bans.IsBanned("127.0.0.1", time.Now()))
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("Misbehaving session is still connected")
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBase58RoundTripKeepsLeadingZeros(t *testing.T) {
+	for _, input := range [][]byte{
+		{0x00, 0x01, 0x02},
+		{0x00, 0x00, 0x00, 0xff},
+		{0x05, 0x00, 0x01},
+	} {
+		encoded := Base58Encode(input)
+		assert.Equal(t, input, Base58Decode(encoded), "%s", encoded)
+	}
+	assert.Equal(t, "111", string(Base58Encode([]byte{0, 0, 0x00})))
+}
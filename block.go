@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"time"
 )
@@ -10,9 +11,32 @@ type Block struct {
 	Timestamp     int64
 	Transactions  []*Transaction
 	PrevBlockHash []byte
+	MerkleRoot    []byte
 	Hash          []byte
 	Nonce         int
 	Height        int
+	Bits          int
+}
+
+// BlockHeader is a block without its transactions. It carries everything
+// needed to check the block's proof-of-work and place it in the chain.
+type BlockHeader struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	MerkleRoot    []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+	Bits          int
+}
+
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{b.Timestamp, b.PrevBlockHash, b.MerkleRoot, b.Hash, b.Nonce, b.Height, b.Bits}
+}
+
+// Block returns a block with the header's fields and no transactions.
+func (h *BlockHeader) Block() *Block {
+	return &Block{h.Timestamp, nil, h.PrevBlockHash, h.MerkleRoot, h.Hash, h.Nonce, h.Height, h.Bits}
 }
 
 func (b *Block) Serialize() []byte {
@@ -40,18 +64,36 @@ func (b *Block) HashTransactions() []byte {
 	return mTree.RootNode.Data
 }
 
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height}
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height, bits int) *Block {
+	block := newBlockTemplate(transactions, prevBlockHash, height, bits)
+	block.Mine(context.Background())
 
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+	return block
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+// newBlockTemplate assembles a block that still has to be mined.
+func newBlockTemplate(transactions []*Transaction, prevBlockHash []byte, height, bits int) *Block {
+	block := &Block{time.Now().Unix(), transactions, prevBlockHash, nil, []byte{}, 0, height, bits}
+	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
 
+// Mine runs the proof-of-work for the block and stores the nonce and hash
+// it finds. It stops early with an error when ctx is cancelled.
+func (b *Block) Mine(ctx context.Context) error {
+	pow := NewProofOfWork(b)
+	nonce, hash, err := pow.Run(ctx, miningThreads)
+	if err != nil {
+		return err
+	}
+
+	b.Hash = hash
+	b.Nonce = nonce
+
+	return nil
+}
+
 func DeserializeBlock(d []byte) *Block {
 	var block Block
 	block.DeserializeBlock(d)
@@ -60,5 +102,5 @@ func DeserializeBlock(d []byte) *Block {
 }
 
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, chainParams.InitialBits)
 }
@@ -2,22 +2,29 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"log"
+	"math/big"
 	"os"
+	"sort"
+	"time"
 )
 
 const database = "b_%s.db"
 const prefix = "blocks"
+const chainWorkPrefix = "chainwork"
+const heightPrefix = "height"
+const maxLocatorSize = 101
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
 type Blockchain struct {
 	tip []byte
 	db  *badger.DB
+	now func() time.Time
 }
 
 func NewBlockchain(nodeID string) *Blockchain {
@@ -42,7 +49,8 @@ func NewBlockchain(nodeID string) *Blockchain {
 		return nil
 	})
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip, db, time.Now}
+	bc.indexActiveChain()
 
 	return &bc
 }
@@ -54,76 +62,294 @@ func CreateBlockchain(address, nodeID string) *Blockchain {
 		os.Exit(1)
 	}
 
-	var tip []byte
-	cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+	db, _ := badger.Open(badger.DefaultOptions(dbFile))
+
+	return initBlockchain(address, db)
+}
+
+func initBlockchain(address string, db *badger.DB) *Blockchain {
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
 	genesis := NewGenesisBlock(cbtx)
 
-	db, _ := badger.Open(badger.DefaultOptions(dbFile))
+	return newBlockchainFromGenesis(genesis, db)
+}
 
+// newBlockchainFromGenesis stores genesis in an empty db and makes it the
+// tip.
+func newBlockchainFromGenesis(genesis *Block, db *badger.DB) *Blockchain {
 	db.Update(func(txn *badger.Txn) error {
 		//b, _ := tx.CreateBucket([]byte(bucket))
 		p := []byte(prefix)
 		txn.Set(append(p, genesis.Hash...), genesis.Serialize())
+		txn.Set(append([]byte(chainWorkPrefix), genesis.Hash...), blockWork(genesis.Bits).Bytes())
 		txn.Set([]byte(prefix+"l"), genesis.Hash)
-
-		tip = genesis.Hash
+		txn.Set(heightKey(genesis.Height), genesis.Hash)
 
 		return nil
 	})
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{genesis.Hash, db, time.Now}
 	return &bc
 }
 
-func (bc *Blockchain) AddBlock(block *Block) {
-	bc.db.Update(func(txn *badger.Txn) error {
-		//b := tx.Bucket([]byte(bucket))
-		p := []byte(prefix)
-		item, _ := txn.Get(append(p, block.Hash...))
+// AddBlock validates and stores block and makes the branch with the most
+// cumulative work the active chain. It returns the blocks that were
+// connected to and disconnected from the active chain as a result. Invalid
+// blocks are rejected with a *ValidationError and never stored.
+func (bc *Blockchain) AddBlock(block *Block) (connected, disconnected []*Block, err error) {
+	if bc.HasBlock(block.Hash) {
+		return nil, nil, nil
+	}
 
-		var blockInDb []byte
-		_ = item.Value(func(val []byte) error {
-			blockInDb = val
-			return nil
-		})
+	err = bc.ValidateBlock(block)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if blockInDb != nil {
-			return nil
+	work := blockWork(block.Bits)
+	work.Add(work, bc.GetChainWork(block.PrevBlockHash))
+
+	if work.Cmp(bc.GetChainWork(bc.tip)) <= 0 {
+		bc.storeBlock(block, work)
+		return nil, nil, nil
+	}
+
+	return bc.reorganize(block, work)
+}
+
+// reorganize disconnects active blocks back to the fork point with the
+// branch ending at newTip and then connects that branch. If a block of the
+// branch turns out to be invalid, the previous active chain is restored.
+func (bc *Blockchain) reorganize(newTip *Block, work *big.Int) (connected, disconnected []*Block, err error) {
+	UTXOSet := UTXOSet{bc}
+
+	oldBranch := bc.mustGetBlock(bc.tip)
+	newBranch := newTip
+	for !bytes.Equal(oldBranch.Hash, newBranch.Hash) {
+		if oldBranch.Height >= newBranch.Height {
+			disconnected = append(disconnected, oldBranch)
+			oldBranch = bc.mustGetBlock(oldBranch.PrevBlockHash)
+		} else {
+			connected = append([]*Block{newBranch}, connected...)
+			newBranch = bc.mustGetBlock(newBranch.PrevBlockHash)
 		}
+	}
+
+	for _, block := range disconnected {
+		bc.disconnectBlock(block)
+	}
 
-		blockData := block.Serialize()
-		err := txn.Set(append(p, block.Hash...), blockData)
+	for i, block := range connected {
+		err = UTXOSet.CheckBlockInputs(block)
 		if err != nil {
-			log.Panic(err)
+			for j := i - 1; j >= 0; j-- {
+				bc.disconnectBlock(connected[j])
+			}
+			for j := len(disconnected) - 1; j >= 0; j-- {
+				bc.connectBlock(disconnected[j], nil)
+			}
+			if block != newTip {
+				bc.deleteBlock(block.Hash)
+			}
+
+			return nil, nil, err
 		}
 
-		item, _ = txn.Get([]byte(prefix + "l"))
+		if block == newTip {
+			bc.connectBlock(block, work)
+		} else {
+			bc.connectBlock(block, nil)
+		}
+	}
 
-		var lastHash []byte
-		_ = item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
+	if len(disconnected) > 0 {
+		fmt.Printf("Reorganized: disconnected %d blocks, connected %d blocks\n", len(disconnected), len(connected))
+	}
 
-		item, _ = txn.Get(append(p, lastHash...))
+	return connected, disconnected, nil
+}
 
-		var lastBlockData []byte
-		_ = item.Value(func(val []byte) error {
-			lastBlockData = val
-			return nil
-		})
-		lastBlock := DeserializeBlock(lastBlockData)
+func (bc *Blockchain) storeBlock(block *Block, work *big.Int) {
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		return putBlock(txn, block, work)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func putBlock(txn *badger.Txn, block *Block, work *big.Int) error {
+	p := []byte(prefix)
+	err := txn.Set(append(p, block.Hash...), block.Serialize())
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(append([]byte(chainWorkPrefix), block.Hash...), work.Bytes())
+}
+
+func (bc *Blockchain) deleteBlock(hash []byte) {
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		txn.Delete(append([]byte(prefix), hash...))
+
+		return txn.Delete(append([]byte(chainWorkPrefix), hash...))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte(prefix+"l"), block.Hash)
+// connectBlock applies block, a child of the tip, to the UTXO set and makes
+// it the tip. Both happen in one transaction, so that a crash cannot leave
+// the UTXO set and the tip apart. With work, block is stored along with
+// them.
+func (bc *Blockchain) connectBlock(block *Block, work *big.Int) {
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		if work != nil {
+			err := putBlock(txn, block, work)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			bc.tip = block.Hash
+		}
+		err := UTXOSet{bc}.update(txn, block)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		return setTip(txn, block.Hash, block.Height)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc.tip = block.Hash
+}
+
+// disconnectBlock reverts block, the tip, in the UTXO set and makes its
+// parent the tip, in one transaction like connectBlock.
+func (bc *Blockchain) disconnectBlock(block *Block) {
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		err := UTXOSet{bc}.disconnect(txn, block)
+		if err != nil {
+			return err
+		}
+
+		return setTip(txn, block.PrevBlockHash, block.Height-1)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc.tip = block.PrevBlockHash
+}
+
+// setTip makes the block hash at height the tip within txn. The tip only
+// ever moves by one block, so the height index needs to lose at most the
+// entry above.
+func setTip(txn *badger.Txn, hash []byte, height int) error {
+	err := txn.Set([]byte(prefix+"l"), hash)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(heightKey(height), hash)
+	if err != nil {
+		return err
+	}
+
+	return txn.Delete(heightKey(height + 1))
+}
+
+// heightKey is the key of the height index entry holding the hash of the
+// active block at height.
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+
+	return key
+}
+
+// ActiveHash returns the hash of the active block at height, or nil if the
+// active chain is not that long.
+func (bc *Blockchain) ActiveHash(height int) []byte {
+	var hash []byte
+	err := bc.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(height))
+		if err != nil {
+			return err
+		}
+		hash, err = item.ValueCopy(nil)
+
+		return err
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		log.Panic(err)
+	}
+
+	return hash
+}
+
+// indexActiveChain fills in the height index for a database written before
+// there was one.
+func (bc *Blockchain) indexActiveChain() {
+	tip := bc.mustGetBlock(bc.tip)
+	if bytes.Equal(bc.ActiveHash(tip.Height), tip.Hash) {
+		return
+	}
+
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		for block := tip; ; block = bc.mustGetBlock(block.PrevBlockHash) {
+			err := txn.Set(heightKey(block.Height), block.Hash)
+			if err != nil {
+				return err
+			}
+			if len(block.PrevBlockHash) == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (bc *Blockchain) mustGetBlock(hash []byte) *Block {
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &block
+}
+
+func (bc *Blockchain) parent(block *Block) *Block {
+	return bc.mustGetBlock(block.PrevBlockHash)
+}
+
+func (bc *Blockchain) HasBlock(hash []byte) bool {
+	_, err := bc.GetBlock(hash)
+
+	return err == nil
+}
+
+// GetChainWork returns the cumulative proof-of-work of the chain ending at
+// hash, or nil if the block is unknown.
+func (bc *Blockchain) GetChainWork(hash []byte) *big.Int {
+	var work *big.Int
+
+	bc.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte(chainWorkPrefix), hash...))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			work = new(big.Int).SetBytes(val)
+			return nil
+		})
 	})
+
+	return work
 }
 
 func (bc *Blockchain) GetBestHeight() int {
@@ -159,10 +385,13 @@ func (bc *Blockchain) GetBestHeight() int {
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	bc.db.View(func(txn *badger.Txn) error {
+	err := bc.db.View(func(txn *badger.Txn) error {
 		//b := tx.Bucket([]byte(bucket))
 		p := []byte(prefix)
-		item, _ := txn.Get(append(p, blockHash...))
+		item, err := txn.Get(append(p, blockHash...))
+		if err != nil {
+			return errors.New("Block is not found.")
+		}
 
 		var blockData []byte
 		_ = item.Value(func(val []byte) error {
@@ -179,74 +408,157 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 		return nil
 	})
 
-	return block, nil
+	return block, err
 }
 
-func (bc *Blockchain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-	bci := bc.Iterator()
+// BlockLocator describes the active chain to a peer, starting at the tip.
+func (bc *Blockchain) BlockLocator() [][]byte {
+	return buildLocator(bc.tip, func(hash []byte) []byte {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil
+		}
+
+		return block.PrevBlockHash
+	})
+}
+
+// buildLocator walks back from start using parent and lists the first ten
+// hashes one by one, then ever sparser ones at doubling steps. The last
+// hash is always genesis.
+func buildLocator(start []byte, parent func(hash []byte) []byte) [][]byte {
+	var locator [][]byte
+	hash := start
+	step := 1
 
 	for {
-		block := bci.Next()
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
 
-		blocks = append(blocks, block.Hash)
+		for i := 0; i < step; i++ {
+			next := parent(hash)
+			if len(next) == 0 {
+				if !bytes.Equal(hash, locator[len(locator)-1]) {
+					locator = append(locator, hash)
+				}
+				return locator
+			}
+			hash = next
+		}
+	}
+}
 
-		if len(block.PrevBlockHash) == 0 {
+// LocateBlocks finds the most recent active block listed in locator and
+// returns the hashes of the active blocks after it, oldest first. The list
+// ends at stop if it is reached and holds at most max hashes. It is empty
+// when locator shares no block with the active chain. Only the first
+// maxLocatorSize hashes of locator are looked at.
+func (bc *Blockchain) LocateBlocks(locator [][]byte, stop []byte, max int) [][]byte {
+	if len(locator) > maxLocatorSize {
+		locator = locator[:maxLocatorSize]
+	}
+
+	fork := -1
+	for _, hash := range locator {
+		block, err := bc.GetBlock(hash)
+		if err == nil && block.Height > fork && bytes.Equal(bc.ActiveHash(block.Height), hash) {
+			fork = block.Height
+		}
+	}
+	if fork < 0 {
+		return nil
+	}
+
+	var hashes [][]byte
+	for height := fork + 1; len(hashes) < max; height++ {
+		hash := bc.ActiveHash(height)
+		if hash == nil {
+			break
+		}
+		hashes = append(hashes, hash)
+		if bytes.Equal(hash, stop) {
 			break
 		}
 	}
 
-	return blocks
+	return hashes
 }
 
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+// NextBits returns the difficulty a block built on top of prev must carry.
+// It only changes every RetargetInterval blocks, based on how long the
+// previous window took to mine.
+func (bc *Blockchain) NextBits(prev *Block) int {
+	return nextBits(prev, bc.parent)
+}
 
-	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: Invalid transaction")
-		}
+// nextBits is NextBits for a chain whose blocks, or headers, are walked
+// back with parent.
+func nextBits(prev *Block, parent func(*Block) *Block) int {
+	if (prev.Height+1)%chainParams.RetargetInterval != 0 {
+		return prev.Bits
 	}
 
-	bc.db.View(func(txn *badger.Txn) error {
-		//b := tx.Bucket([]byte(bucket))
-		p := []byte(prefix)
-		item, _ := txn.Get([]byte(prefix + "l"))
-
-		_ = item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
+	first := prev
+	for i := 0; i < chainParams.RetargetInterval-1 && len(first.PrevBlockHash) > 0; i++ {
+		first = parent(first)
+	}
 
-		item, _ = txn.Get(append(p, lastHash...))
+	return retargetBits(prev.Bits, prev.Timestamp-first.Timestamp)
+}
 
-		var blockData []byte
-		_ = item.Value(func(val []byte) error {
-			blockData = val
-			return nil
-		})
+// MedianTimePast returns the median timestamp of block and the blocks
+// before it, MedianTimeSpan blocks in total.
+func (bc *Blockchain) MedianTimePast(block *Block) int64 {
+	return medianTimePast(block, bc.parent)
+}
 
-		block := DeserializeBlock(blockData)
+// medianTimePast is MedianTimePast for a chain whose blocks, or headers,
+// are walked back with parent.
+func medianTimePast(block *Block, parent func(*Block) *Block) int64 {
+	var timestamps []int64
 
-		lastHeight = block.Height
+	for i := 0; i < chainParams.MedianTimeSpan; i++ {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+		block = parent(block)
+	}
 
-		return nil
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
 	})
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight)
+	return timestamps[len(timestamps)/2]
+}
 
-	bc.db.Update(func(txn *badger.Txn) error {
-		//b := tx.Bucket([]byte(bucket))
-		p := []byte(prefix)
-		txn.Set(append(p, newBlock.Hash...), newBlock.Serialize())
-		txn.Set([]byte(prefix+"l"), newBlock.Hash)
-		bc.tip = newBlock.Hash
+// NewBlockTemplate assembles a block on top of prev that still has to be
+// mined, with the difficulty and a timestamp the chain rules accept.
+func (bc *Blockchain) NewBlockTemplate(transactions []*Transaction, prev *Block) *Block {
+	block := newBlockTemplate(transactions, prev.Hash, prev.Height+1, bc.NextBits(prev))
 
-		return nil
-	})
+	block.Timestamp = bc.now().Unix()
+	if mtp := bc.MedianTimePast(prev); block.Timestamp <= mtp {
+		block.Timestamp = mtp + 1
+	}
 
-	return newBlock
+	return block
+}
+
+// RequiredBits returns the difficulty the chain rules require for block.
+func (bc *Blockchain) RequiredBits(block *Block) int {
+	if len(block.PrevBlockHash) == 0 {
+		return chainParams.InitialBits
+	}
+
+	prev, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return bc.NextBits(&prev)
 }
 
 func (bc *Blockchain) Iterator() *BlockchainIterator {
@@ -277,9 +589,12 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 					}
 				}
 
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = NewTXOutputs(block.Height, tx.IsCoinbase())
+					UTXO[txID] = outs
+				}
+				outs.Outputs[outIdx] = out
 			}
 
 			if tx.IsCoinbase() == false {
@@ -298,55 +613,6 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 	return UTXO
 }
 
-func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
-
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
-	}
-
-	return Transaction{}, errors.New("Transaction is not found")
-}
-
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-
-	for _, vin := range tx.Vin {
-		prevTX, _ := bc.FindTransaction(vin.Txid)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
-	}
-
-	tx.Sign(privKey, prevTXs)
-}
-
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
-	}
-
-	prevTXs := make(map[string]Transaction)
-
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
-	}
-
-	return tx.Verify(prevTXs)
-}
-
 func dbExists(dbFile string) bool {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		return false
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBlockchain(t *testing.T, address string) *Blockchain {
+	params := chainParams
+	chainParams.InitialBits = 4
+	chainParams.MinBits = 1
+	chainParams.CoinbaseMaturity = 1
+	t.Cleanup(func() { chainParams = params })
+
+	bc := initBlockchain(address, newTestDB(t))
+	UTXOSet{bc}.Reindex()
+
+	return bc
+}
+
+// newTestChainFrom returns a second chain sharing the genesis block of a
+// chain made by newTestBlockchain.
+func newTestChainFrom(t *testing.T, genesis *Block) *Blockchain {
+	bc := newBlockchainFromGenesis(genesis, newTestDB(t))
+	UTXOSet{bc}.Reindex()
+
+	return bc
+}
+
+func newTestDB(t *testing.T) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func mineTestBlock(bc *Blockchain, prev *Block, miner string, txs ...*Transaction) *Block {
+	txs = append([]*Transaction{NewCoinbaseTX(miner, "", prev.Height+1, 0)}, txs...)
+
+	block := bc.NewBlockTemplate(txs, prev)
+	block.Mine(context.Background())
+
+	return block
+}
+
+func testBalance(u UTXOSet, w *Wallet) int {
+	balance := 0
+	for _, out := range u.FindUTXO(HashPubKey(w.PublicKey)) {
+		balance += out.Value
+	}
+
+	return balance
+}
+
+func TestAddBlockReorganizesToHeavierBranch(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+	miner := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	UTXOSet := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+
+	spend := NewUTXOTransaction(alice, string(bob.GetAddress()), 3, 0, &UTXOSet)
+	a1 := mineTestBlock(bc, genesis, miner, spend)
+	connected, disconnected, err := bc.AddBlock(a1)
+	assert.NoError(t, err)
+	assert.Len(t, connected, 1)
+	assert.Empty(t, disconnected)
+	assert.Equal(t, chainParams.InitialSubsidy-3, testBalance(UTXOSet, alice))
+	assert.Equal(t, 3, testBalance(UTXOSet, bob))
+
+	b1 := mineTestBlock(bc, genesis, miner)
+	connected, _, err = bc.AddBlock(b1)
+	assert.NoError(t, err)
+	assert.Empty(t, connected, "Branch with equal work does not replace the tip")
+	assert.Equal(t, a1.Hash, bc.tip)
+
+	b2 := mineTestBlock(bc, b1, miner)
+	connected, disconnected, err = bc.AddBlock(b2)
+	assert.NoError(t, err)
+	if assert.Len(t, connected, 2) {
+		assert.Equal(t, b1.Hash, connected[0].Hash)
+		assert.Equal(t, b2.Hash, connected[1].Hash)
+	}
+	if assert.Len(t, disconnected, 1) {
+		assert.Equal(t, a1.Hash, disconnected[0].Hash)
+	}
+	assert.Equal(t, b2.Hash, bc.tip)
+
+	assert.Equal(t, chainParams.InitialSubsidy, testBalance(UTXOSet, alice), "Output spent on the abandoned branch is restored")
+	assert.Equal(t, 0, testBalance(UTXOSet, bob))
+}
+
+func TestBlockLocatorAndLocateBlocks(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	chain := []*Block{bc.mustGetBlock(bc.tip)}
+	for i := 0; i < 15; i++ {
+		block := mineTestBlock(bc, chain[i], address)
+		_, _, err := bc.AddBlock(block)
+		assert.NoError(t, err)
+		chain = append(chain, block)
+	}
+
+	var heights []int
+	for _, hash := range bc.BlockLocator() {
+		heights = append(heights, bc.mustGetBlock(hash).Height)
+	}
+	assert.Equal(t, []int{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 4, 0}, heights)
+
+	locator := [][]byte{[]byte("unknown"), chain[2].Hash, chain[0].Hash}
+	hashes := bc.LocateBlocks(locator, nil, 100)
+	if assert.Len(t, hashes, 13) {
+		assert.Equal(t, chain[3].Hash, hashes[0])
+		assert.Equal(t, chain[15].Hash, hashes[12])
+	}
+
+	hashes = bc.LocateBlocks(locator, chain[4].Hash, 100)
+	assert.Len(t, hashes, 2, "The list ends at the stop hash")
+	assert.Len(t, bc.LocateBlocks(locator, nil, 5), 5)
+	assert.Empty(t, bc.LocateBlocks([][]byte{[]byte("other genesis")}, nil, 100))
+
+	// A heavier branch from height 13 replaces the last two blocks.
+	prev := chain[13]
+	var branch []*Block
+	for i := 0; i < 3; i++ {
+		block := mineTestBlock(bc, prev, address)
+		_, _, err := bc.AddBlock(block)
+		assert.NoError(t, err)
+		branch = append(branch, block)
+		prev = block
+	}
+	assert.Equal(t, branch[2].Hash, bc.tip)
+
+	hashes = bc.LocateBlocks([][]byte{chain[15].Hash, chain[12].Hash}, nil, 100)
+	assert.Equal(t, [][]byte{chain[13].Hash, branch[0].Hash, branch[1].Hash, branch[2].Hash}, hashes,
+		"Blocks that are no longer active are not fork points")
+	assert.Nil(t, bc.ActiveHash(17))
+}
+
+func TestConnectBlockIsAllOrNothing(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	UTXOSet := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+	before := UTXOSet.CountTransactions()
+
+	// The coinbase is applied before the second transaction fails.
+	bad := &Transaction{[]byte("bad"), []TXInput{{[]byte("missing"), 0, nil, 0}}, nil}
+	block := mineTestBlock(bc, genesis, address, bad)
+	assert.Panics(t, func() { bc.connectBlock(block, blockWork(block.Bits)) })
+
+	assert.Equal(t, genesis.Hash, bc.tip)
+	assert.Equal(t, 0, bc.GetBestHeight())
+	assert.Nil(t, bc.ActiveHash(1))
+	assert.False(t, bc.HasBlock(block.Hash))
+	assert.Equal(t, before, UTXOSet.CountTransactions())
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 const getBalance = "balance"
@@ -14,8 +18,14 @@ const createWallet = "createw"
 const listAddresses = "list"
 const reindexUTXO = "reindex"
 const send = "send"
+const bumpFee = "bumpfee"
 const printChain = "print"
 const startNode = "start"
+const getSupply = "supply"
+const listBans = "listbans"
+const banPeer = "ban"
+const clearBans = "clearbans"
+const peerInfo = "peers"
 
 type CLI struct{}
 
@@ -34,16 +44,45 @@ func (cli *CLI) Run() {
 	listAddressesCmd := flag.NewFlagSet(listAddresses, flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet(reindexUTXO, flag.ExitOnError)
 	sendCmd := flag.NewFlagSet(send, flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet(bumpFee, flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet(printChain, flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet(startNode, flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet(getSupply, flag.ExitOnError)
+	listBansCmd := flag.NewFlagSet(listBans, flag.ExitOnError)
+	banPeerCmd := flag.NewFlagSet(banPeer, flag.ExitOnError)
+	clearBansCmd := flag.NewFlagSet(clearBans, flag.ExitOnError)
+	peerInfoCmd := flag.NewFlagSet(peerInfo, flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee left for the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendNode := sendCmd.String("node", defaultSeedNode, "Address of the node to hand the transaction to")
+	sendRBF := sendCmd.Bool("rbf", false, "Let the transaction be replaced by one paying a higher fee while it is pending")
+	bumpFeeTxid := bumpFeeCmd.String("txid", "", "ID of the pending transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New fee left for the miner")
+	bumpFeeNode := bumpFeeCmd.String("node", defaultSeedNode, "Address of the node the transaction is pending at")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeThreads := startNodeCmd.Int("threads", miningThreads, "Number of mining goroutines")
+	startNodeMinTxs := startNodeCmd.Int("mintxs", 2, "Minimum number of transactions to mine a block")
+	startNodeMineEmpty := startNodeCmd.Bool("empty", false, "Mine blocks even without transactions")
+	startNodeConfig := startNodeCmd.String("config", "", "Read the node settings from FILE instead of node_NODE_ID.conf")
+	startNodeListen := startNodeCmd.String("listen", "", "Address to accept peers on")
+	startNodeAdvertise := startNodeCmd.String("advertise", "", "Address peers should connect to, if not the listen address")
+	startNodeSeeds := startNodeCmd.String("seeds", "", "Comma-separated addresses of the peers to start from")
+	startNodeMaxInbound := startNodeCmd.Int("maxinbound", defaultMaxInbound, "Maximum number of inbound peers")
+	startNodeMaxOutbound := startNodeCmd.Int("maxoutbound", defaultMaxOutbound, "Number of peers to connect to")
+	startNodeMaxMempool := startNodeCmd.Int("maxmempool", defaultMaxMempoolSize, "Maximum size of the pending transactions in bytes, 0 for no limit")
+	startNodeMempoolExpiry := startNodeCmd.Duration("mempoolexpiry", defaultMempoolExpiry, "How long transactions may stay pending, 0 for ever")
+	banPeerAddress := banPeerCmd.String("ip", "", "IP address of the peer to ban")
+	banPeerDuration := banPeerCmd.Duration("for", defaultBanDuration, "How long the ban lasts")
+	banPeerNode := banPeerCmd.String("node", fmt.Sprintf("localhost:%s", nodeID), "Address of the running node")
+	clearBansAddress := clearBansCmd.String("ip", "", "Only lift the ban on IP")
+	clearBansNode := clearBansCmd.String("node", fmt.Sprintf("localhost:%s", nodeID), "Address of the running node")
+	peerInfoNode := peerInfoCmd.String("node", fmt.Sprintf("localhost:%s", nodeID), "Address of the running node to ask")
 
 	switch os.Args[1] {
 	case getBalance:
@@ -58,10 +97,22 @@ func (cli *CLI) Run() {
 		reindexUTXOCmd.Parse(os.Args[2:])
 	case send:
 		sendCmd.Parse(os.Args[2:])
+	case bumpFee:
+		bumpFeeCmd.Parse(os.Args[2:])
 	case printChain:
 		printChainCmd.Parse(os.Args[2:])
 	case startNode:
 		startNodeCmd.Parse(os.Args[2:])
+	case getSupply:
+		getSupplyCmd.Parse(os.Args[2:])
+	case listBans:
+		listBansCmd.Parse(os.Args[2:])
+	case banPeer:
+		banPeerCmd.Parse(os.Args[2:])
+	case clearBans:
+		clearBansCmd.Parse(os.Args[2:])
+	case peerInfo:
+		peerInfoCmd.Parse(os.Args[2:])
 	default:
 		os.Exit(1)
 	}
@@ -97,24 +148,84 @@ func (cli *CLI) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendNode, *sendMine, *sendRBF)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxid == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+
+		cli.bumpFee(*bumpFeeTxid, *bumpFeeFee, nodeID, *bumpFeeNode)
 	}
 
 	if printChainCmd.Parsed() {
 		cli.printChain(nodeID)
 	}
 
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(nodeID)
+	}
+
+	if listBansCmd.Parsed() {
+		cli.listBans(nodeID)
+	}
+
+	if banPeerCmd.Parsed() {
+		if *banPeerAddress == "" || *banPeerDuration <= 0 {
+			banPeerCmd.Usage()
+			os.Exit(1)
+		}
+
+		cli.banPeer(*banPeerAddress, *banPeerDuration, nodeID, *banPeerNode)
+	}
+
+	if clearBansCmd.Parsed() {
+		cli.clearBans(*clearBansAddress, nodeID, *clearBansNode)
+	}
+
+	if peerInfoCmd.Parsed() {
+		cli.peerInfo(*peerInfoNode)
+	}
+
 	if startNodeCmd.Parsed() {
 		if nodeID == "" {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		miningThreads = *startNodeThreads
+
+		cfg, err := LoadConfig(nodeID, *startNodeConfig)
+		if err != nil {
+			log.Panic(err)
+		}
+		// Flags given on the command line win over the config file.
+		startNodeCmd.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "listen":
+				cfg.Listen = *startNodeListen
+			case "advertise":
+				cfg.Advertise = *startNodeAdvertise
+			case "seeds":
+				cfg.Seeds = splitList(*startNodeSeeds)
+			case "maxinbound":
+				cfg.MaxInbound = *startNodeMaxInbound
+			case "maxoutbound":
+				cfg.MaxOutbound = *startNodeMaxOutbound
+			case "maxmempool":
+				cfg.MaxMempoolSize = *startNodeMaxMempool
+			case "mempoolexpiry":
+				cfg.MempoolExpiry = *startNodeMempoolExpiry
+			}
+		})
+
+		cli.startNode(nodeID, cfg, *startNodeMiner, *startNodeMinTxs, *startNodeMineEmpty)
 	}
 }
 
@@ -169,6 +280,94 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
 
+func (cli *CLI) getSupply(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+
+	UTXOSet := UTXOSet{bc}
+	height := bc.GetBestHeight()
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Current block subsidy: %d\n", GetBlockSubsidy(height))
+	fmt.Printf("Circulating supply: %d\n", UTXOSet.TotalValue())
+	fmt.Printf("Scheduled supply at this height: %d\n", ScheduledSupply(height))
+	fmt.Printf("Maximum supply: %d\n", MaxSupply())
+}
+
+func (cli *CLI) listBans(nodeID string) {
+	bans, err := LoadBanList(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	now := time.Now()
+	for _, address := range bans.Active(now) {
+		until := bans.Until(address)
+		fmt.Printf("%s until %s (%s left)\n", address, until.Format(time.RFC3339), until.Sub(now).Round(time.Second))
+	}
+}
+
+func (cli *CLI) banPeer(ip string, duration time.Duration, nodeID, node string) {
+	updateBans(setban{ip, time.Now().Add(duration)}, nodeID, node)
+	fmt.Printf("Banned %s for %s\n", ip, duration)
+}
+
+func (cli *CLI) clearBans(ip, nodeID, node string) {
+	updateBans(setban{ip, time.Time{}}, nodeID, node)
+	fmt.Println("Done!")
+}
+
+// updateBans has the node running at node apply request, so that it takes
+// effect at once and is not overwritten. If the node cannot be reached,
+// the ban list file of nodeID is edited instead.
+func updateBans(request setban, nodeID, node string) {
+	_, err := setBan(node, request)
+	if err == nil {
+		return
+	}
+	fmt.Printf("Node at %s did not take the ban (%s), editing the ban list instead\n", node, err)
+
+	bans, err := LoadBanList(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	request.apply(bans)
+}
+
+func (cli *CLI) peerInfo(node string) {
+	peers, err := queryPeerInfo(node)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	now := time.Now()
+	for _, info := range peers {
+		direction := "outbound"
+		if info.Inbound {
+			direction = "inbound"
+		}
+
+		latency := "-"
+		if info.Latency > 0 {
+			latency = info.Latency.String()
+		}
+
+		lastRecv := "never"
+		if !info.LastRecv.IsZero() {
+			lastRecv = now.Sub(info.LastRecv).Round(time.Second).String() + " ago"
+		}
+
+		address := info.Address
+		if info.ListenAddr != "" && info.ListenAddr != info.Address {
+			address += " (listens on " + info.ListenAddr + ")"
+		}
+
+		fmt.Printf("%s %s version %d height %d latency %s connected %s ago, last message %s, ban score %d\n",
+			address, direction, info.Version, info.BestHeight, latency,
+			now.Sub(info.ConnectedAt).Round(time.Second), lastRecv, info.BanScore)
+	}
+}
+
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  createbc -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
@@ -177,8 +376,15 @@ func (cli *CLI) printUsage() {
 	fmt.Println("  list - Lists all addresses from the wallet file")
 	fmt.Println("  print - Print all the blocks of the blockchain")
 	fmt.Println("  reindex - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  start -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -node ADDR -mine -rbf - Send AMOUNT of coins from FROM address to TO, leaving FEE to the miner, through the node at ADDR (localhost:3000 by default). Mine on the same node, when -mine is set. With -rbf the fee can be bumped while the transaction is pending")
+	fmt.Println("  bumpfee -txid TXID -fee FEE -node ADDR - Replace the pending transaction TXID, sent with -rbf, by one leaving FEE to the miner, taken from the change")
+	fmt.Println("  supply - Compare the coins in circulation with the issuance schedule")
+	fmt.Println("  listbans - List the banned peers and when their bans end")
+	fmt.Println("  ban -ip IP -for DURATION -node ADDR - Refuse connections to and from IP for DURATION (e.g. 12h) on the node running at ADDR, or in the ban list if it cannot be reached")
+	fmt.Println("  clearbans -ip IP -node ADDR - Lift the ban on IP, or on every peer without -ip")
+	fmt.Println("  peers -node ADDR - Show the peers of the running node at ADDR (localhost:NODE_ID by default) with their latency")
+	fmt.Println("  start -miner ADDRESS -threads N -mintxs N -empty - Start a node with ID specified in NODE_ID env. var. -miner enables mining on N goroutines, once -mintxs transactions are pending or always with -empty")
+	fmt.Println("        -config FILE -listen ADDR -advertise ADDR -seeds ADDR,... -maxinbound N -maxoutbound N -maxmempool BYTES -mempoolexpiry DURATION - Node settings, read from node_NODE_ID.conf (or FILE) as key = value lines (listen, advertise, seed, maxinbound, maxoutbound, maxmempool, mempoolexpiry) and overridden by the flags")
 }
 
 func (cli *CLI) printChain(nodeID string) {
@@ -194,7 +400,7 @@ func (cli *CLI) printChain(nodeID string) {
 		fmt.Printf("Prev. block: %x\n", block.PrevBlockHash)
 		fmt.Printf("Height: %d\n", block.Height)
 		pow := NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
+		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate(bc.RequiredBits(block))))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
@@ -222,7 +428,7 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) send(from, to string, amount, fee int, nodeID, node string, mineNow, replaceable bool) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -238,23 +444,109 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	wallets, _ := NewWallets(nodeID)
 	wallet := wallets.GetWallet(from)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
-
 	if mineNow {
-		cbTx := NewCoinbaseTX(from, "")
-		txs := []*Transaction{cbTx, tx}
-
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		tx := NewUTXOTransaction(&wallet, to, amount, fee, &UTXOSet)
+		tip := bc.mustGetBlock(bc.tip)
+		cbTx := NewCoinbaseTX(from, "", tip.Height+1, fee)
+
+		block := bc.NewBlockTemplate([]*Transaction{cbTx, tx}, tip)
+		err := block.Mine(context.Background())
+		if err != nil {
+			log.Panic(err)
+		}
+		_, _, err = bc.AddBlock(block)
+		if err != nil {
+			log.Panic(err)
+		}
 	} else {
-		sendTx(knownNodes[0], tx)
+		// The node's pending transactions may spend coins the chain
+		// still shows, or have change to spend.
+		pending, err := queryMempool(node)
+		if err != nil {
+			log.Panic(err)
+		}
+		tx := NewTransaction(&wallet, to, amount, fee, &UTXOSet, pending, replaceable)
+
+		err = submitTx(node, bc, tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Transaction %x\n", tx.ID)
 	}
 
 	fmt.Println("Success!")
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
-	fmt.Printf("Starting node %s\n", nodeID)
+func (cli *CLI) bumpFee(txid string, fee int, nodeID, node string) {
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic("ERROR: Transaction ID is not valid")
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+
+	UTXOSet := UTXOSet{bc}
+
+	pending, err := queryMempool(node)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var tx *Transaction
+	outputs := make(map[string]TXOutput)
+	for _, p := range pending {
+		if bytes.Equal(p.ID, id) {
+			tx = p
+		}
+		for outIdx, out := range p.Vout {
+			outputs[outpoint(p.ID, outIdx)] = out
+		}
+	}
+	if tx == nil {
+		log.Panic("ERROR: Transaction is not pending")
+	}
+
+	var prevOuts []TXOutput
+	for _, vin := range tx.Vin {
+		out, ok := outputs[outpoint(vin.Txid, vin.Vout)]
+		if !ok {
+			entry, found := UTXOSet.FindOutput(vin.Txid, vin.Vout)
+			if !found {
+				log.Panic("ERROR: Transaction spends missing outputs")
+			}
+			out = entry.Output
+		}
+		prevOuts = append(prevOuts, out)
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	var wallet *Wallet
+	for _, address := range wallets.GetAddresses() {
+		w := wallets.GetWallet(address)
+		if tx.Vin[0].UsesKey(HashPubKey(w.PublicKey)) {
+			wallet = &w
+		}
+	}
+	if wallet == nil {
+		log.Panic("ERROR: Transaction was not sent from this wallet")
+	}
+
+	bump, err := NewFeeBump(wallet, tx, prevOuts, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = submitTx(node, bc, bump)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Transaction %x replaces %x\n", bump.ID, tx.ID)
+}
+
+func (cli *CLI) startNode(nodeID string, cfg Config, minerAddress string, minTxs int, mineEmpty bool) {
+	fmt.Printf("Starting node %s on %s\n", nodeID, cfg.Listen)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
@@ -262,5 +554,5 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	StartServer(nodeID, cfg, minerAddress, minTxs, mineEmpty)
 }
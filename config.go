@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const configFile = "node_%s.conf"
+const defaultSeedNode = "localhost:3000"
+const defaultMaxInbound = 32
+const defaultMaxOutbound = 8
+
+// Config is how a node takes part in the network.
+type Config struct {
+	// Listen is the address the node accepts peers on. Advertise is the
+	// address peers are told to reach it at and defaults to Listen.
+	Listen    string
+	Advertise string
+
+	// Seeds are the peers to start from. Once the node has learned other
+	// addresses they are no different from the rest.
+	Seeds []string
+
+	MaxInbound  int
+	MaxOutbound int
+
+	// MaxMempoolSize caps the pending transactions in bytes, and
+	// MempoolExpiry is how long they may wait to be mined.
+	MaxMempoolSize int
+	MempoolExpiry  time.Duration
+}
+
+func DefaultConfig(nodeID string) Config {
+	return Config{
+		Listen:         fmt.Sprintf("localhost:%s", nodeID),
+		Seeds:          []string{defaultSeedNode},
+		MaxInbound:     defaultMaxInbound,
+		MaxOutbound:    defaultMaxOutbound,
+		MaxMempoolSize: defaultMaxMempoolSize,
+		MempoolExpiry:  defaultMempoolExpiry,
+	}
+}
+
+// LoadConfig returns the configuration of node nodeID: the defaults,
+// overridden by the settings in file, or in node_<nodeID>.conf if file is
+// empty and there is one.
+func LoadConfig(nodeID, file string) (Config, error) {
+	cfg := DefaultConfig(nodeID)
+
+	if file == "" {
+		file = fmt.Sprintf(configFile, nodeID)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return cfg, nil
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	err = cfg.parse(f)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return cfg, nil
+}
+
+// parse reads "key = value" lines. Blank lines and lines starting with #
+// are skipped. Each seed line adds a seed peer, replacing the default ones;
+// an empty seed line leaves the node without seeds.
+func (cfg *Config) parse(r io.Reader) error {
+	seeds := false
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("line %d: expected key = value", line)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "listen":
+			cfg.Listen = value
+		case "advertise":
+			cfg.Advertise = value
+		case "seed":
+			if !seeds {
+				cfg.Seeds = nil
+				seeds = true
+			}
+			if value != "" {
+				cfg.Seeds = append(cfg.Seeds, value)
+			}
+		case "maxinbound", "maxoutbound", "maxmempool":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("line %d: %s must be a non-negative number", line, key)
+			}
+			switch key {
+			case "maxinbound":
+				cfg.MaxInbound = n
+			case "maxoutbound":
+				cfg.MaxOutbound = n
+			default:
+				cfg.MaxMempoolSize = n
+			}
+		case "mempoolexpiry":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("line %d: %s must be a duration such as 72h", line, key)
+			}
+			cfg.MempoolExpiry = d
+		default:
+			return fmt.Errorf("line %d: unknown setting %q", line, key)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// advertised is the address the node tells peers to reach it at.
+func (cfg *Config) advertised() string {
+	if cfg.Advertise != "" {
+		return cfg.Advertise
+	}
+
+	return cfg.Listen
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
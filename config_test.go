@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "node.conf")
+	content := `# test node
+listen = 0.0.0.0:3001
+advertise = node1.example:3001
+seed = node2.example:3000
+seed = node3.example:3000
+maxoutbound = 4
+mempoolexpiry = 1h
+`
+	assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+
+	cfg, err := LoadConfig("3001", file)
+	assert.NoError(t, err)
+	assert.Equal(t, Config{
+		Listen:         "0.0.0.0:3001",
+		Advertise:      "node1.example:3001",
+		Seeds:          []string{"node2.example:3000", "node3.example:3000"},
+		MaxInbound:     defaultMaxInbound,
+		MaxOutbound:    4,
+		MaxMempoolSize: defaultMaxMempoolSize,
+		MempoolExpiry:  time.Hour,
+	}, cfg)
+	assert.Equal(t, "node1.example:3001", cfg.advertised())
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig("no-such-node", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig("no-such-node"), cfg)
+	assert.Equal(t, "localhost:no-such-node", cfg.advertised())
+}
+
+func TestConfigParseErrors(t *testing.T) {
+	for _, content := range []string{"listen", "port = 3000", "maxinbound = many", "maxoutbound = -1", "mempoolexpiry = soon"} {
+		cfg := DefaultConfig("3000")
+		assert.Error(t, cfg.parse(strings.NewReader(content)), content)
+	}
+
+	cfg := DefaultConfig("3000")
+	assert.NoError(t, cfg.parse(strings.NewReader("seed =")))
+	assert.Empty(t, cfg.Seeds, "An empty seed line removes the default seeds")
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"a:1", "b:2"}, splitList(" a:1, ,b:2,"))
+	assert.Empty(t, splitList(""))
+}
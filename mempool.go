@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const mempoolFile = "mempool_%s.dat"
+const defaultMaxMempoolSize = 5000000
+const defaultMempoolExpiry = 72 * time.Hour
+
+// maxMempoolAncestors caps how many pending transactions a new one may
+// depend on, keeping chains short enough to walk.
+const maxMempoolAncestors = 25
+
+// maxMempoolReplacements caps how many pending transactions, counting
+// descendants, a replacement may evict.
+const maxMempoolReplacements = 100
+
+var mempoolExpireInterval = time.Minute
+
+type mempoolEntry struct {
+	tx    *Transaction
+	fee   int
+	size  int
+	added time.Time
+
+	// parents and children are the pending transactions this one spends
+	// from and those spending from it.
+	parents  map[string]bool
+	children map[string]bool
+}
+
+// Mempool holds the validated transactions waiting to be mined. None of
+// them spend the same output, but they may spend the outputs of each
+// other. It keeps at most maxSize bytes of them, dropping the lowest fee
+// rates first, and forgets them after expiry. A zero maxSize or expiry
+// disables the limit. Dropping a transaction drops the ones spending from
+// it as well.
+//
+// A transaction that signals replace-by-fee gives way to one spending the
+// same outputs with a higher fee and fee rate.
+type Mempool struct {
+	maxSize int
+	expiry  time.Duration
+
+	mu    sync.Mutex
+	txs   map[string]*mempoolEntry
+	spent map[string]string
+	size  int
+}
+
+func NewMempool(maxSize int, expiry time.Duration) *Mempool {
+	return &Mempool{
+		maxSize: maxSize,
+		expiry:  expiry,
+		txs:     make(map[string]*mempoolEntry),
+		spent:   make(map[string]string),
+	}
+}
+
+// Add validates tx against the UTXO set and the outputs of the pending
+// transactions and admits it, replacing the pending transactions it
+// conflicts with if they allow it and tx pays more than all of them and
+// their descendants together. The chain must not change while it runs.
+func (mp *Mempool) Add(tx *Transaction, u UTXOSet, now time.Time) error {
+	if tx.IsCoinbase() {
+		return reject(RejectLooseCoinbase, "coinbase %x outside a block", tx.ID)
+	}
+	err := CheckTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if mp.txs[id] != nil {
+		return reject(RejectAlreadyKnown, "transaction %x is already pending", tx.ID)
+	}
+
+	conflicts := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		other, ok := mp.spent[outpoint(vin.Txid, vin.Vout)]
+		if !ok {
+			continue
+		}
+		if !mp.txs[other].tx.Replaceable() {
+			return reject(RejectMempoolConflict, "input %x:%d of transaction %x is already spent by pending %s", vin.Txid, vin.Vout, tx.ID, other)
+		}
+		conflicts[other] = true
+	}
+
+	replaced := make(map[string]bool)
+	for other := range conflicts {
+		replaced[other] = true
+		for d := range mp.descendants(other) {
+			replaced[d] = true
+		}
+	}
+	if len(replaced) > maxMempoolReplacements {
+		return reject(RejectTooManyReplacements, "transaction %x would replace %d pending transactions, at most %d are allowed", tx.ID, len(replaced), maxMempoolReplacements)
+	}
+
+	height := u.Blockchain.GetBestHeight() + 1
+	pending := make(map[string]UTXOEntry)
+	parents := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		parentID := hex.EncodeToString(vin.Txid)
+		if replaced[parentID] {
+			return reject(RejectMempoolConflict, "transaction %x spends from pending %s, which it replaces", tx.ID, parentID)
+		}
+		parent := mp.txs[parentID]
+		if parent == nil || vin.Vout < 0 || vin.Vout >= len(parent.tx.Vout) {
+			continue
+		}
+		pending[outpoint(vin.Txid, vin.Vout)] = UTXOEntry{parent.tx.Vout[vin.Vout], height, false}
+		parents[parentID] = true
+	}
+
+	ancestors := make(map[string]bool)
+	for parent := range parents {
+		ancestors[parent] = true
+		for a := range mp.ancestors(parent) {
+			ancestors[a] = true
+		}
+	}
+	if len(ancestors) > maxMempoolAncestors {
+		return reject(RejectTooLongChain, "transaction %x depends on %d pending transactions, at most %d are allowed", tx.ID, len(ancestors), maxMempoolAncestors)
+	}
+
+	fee, err := u.checkTransactionInputs(tx, height, pending)
+	if err != nil {
+		return err
+	}
+	e := &mempoolEntry{tx, fee, len(tx.Serialize()), now, parents, make(map[string]bool)}
+
+	if len(replaced) > 0 {
+		replacedFee := 0
+		for other := range replaced {
+			replacedFee += mp.txs[other].fee
+		}
+		if fee <= replacedFee {
+			return reject(RejectInsufficientFee, "transaction %x pays %d, no more than the %d of the %d transactions it replaces", tx.ID, fee, replacedFee, len(replaced))
+		}
+		for other := range conflicts {
+			if !mp.txs[other].feeRateBelow(e) {
+				return reject(RejectInsufficientFee, "transaction %x pays no higher fee rate than pending %s it replaces", tx.ID, other)
+			}
+		}
+
+		for other := range replaced {
+			mp.remove(other)
+		}
+		fmt.Printf("Transaction %x replaced %d pending transactions\n", tx.ID, len(replaced))
+	}
+
+	mp.insert(id, e)
+
+	for mp.maxSize > 0 && mp.size > mp.maxSize {
+		victim := mp.lowestFeeRate()
+		removed := mp.removeWithDescendants(victim)
+		if removed[id] {
+			return reject(RejectMempoolFull, "transaction %x pays too little to fit in the mempool", tx.ID)
+		}
+		fmt.Printf("Evicted %d transactions from the full mempool\n", len(removed))
+	}
+
+	return nil
+}
+
+// feeRateBelow reports whether e pays less per byte than other.
+func (e *mempoolEntry) feeRateBelow(other *mempoolEntry) bool {
+	return e.fee*other.size < other.fee*e.size
+}
+
+func (mp *Mempool) insert(id string, e *mempoolEntry) {
+	mp.txs[id] = e
+	mp.size += e.size
+	for _, vin := range e.tx.Vin {
+		mp.spent[outpoint(vin.Txid, vin.Vout)] = id
+	}
+	for parent := range e.parents {
+		mp.txs[parent].children[id] = true
+	}
+}
+
+// remove drops a single transaction. Its children stay, as happens when
+// it gets confirmed.
+func (mp *Mempool) remove(id string) {
+	e := mp.txs[id]
+	if e == nil {
+		return
+	}
+
+	delete(mp.txs, id)
+	mp.size -= e.size
+	for _, vin := range e.tx.Vin {
+		delete(mp.spent, outpoint(vin.Txid, vin.Vout))
+	}
+	for parent := range e.parents {
+		delete(mp.txs[parent].children, id)
+	}
+	for child := range e.children {
+		delete(mp.txs[child].parents, id)
+	}
+}
+
+// removeWithDescendants drops a transaction along with every transaction
+// that depends on it, and returns the IDs of all of them.
+func (mp *Mempool) removeWithDescendants(id string) map[string]bool {
+	removed := mp.descendants(id)
+	removed[id] = true
+	for id := range removed {
+		mp.remove(id)
+	}
+
+	return removed
+}
+
+// descendants returns the pending transactions that spend from id,
+// directly or not.
+func (mp *Mempool) descendants(id string) map[string]bool {
+	found := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		for child := range mp.txs[id].children {
+			if !found[child] {
+				found[child] = true
+				visit(child)
+			}
+		}
+	}
+	if mp.txs[id] != nil {
+		visit(id)
+	}
+
+	return found
+}
+
+// ancestors returns the pending transactions id spends from, directly or
+// not.
+func (mp *Mempool) ancestors(id string) map[string]bool {
+	found := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		for parent := range mp.txs[id].parents {
+			if !found[parent] {
+				found[parent] = true
+				visit(parent)
+			}
+		}
+	}
+	if mp.txs[id] != nil {
+		visit(id)
+	}
+
+	return found
+}
+
+// lowestFeeRate returns the transaction that, together with its
+// descendants, pays the least per byte. Evicting a transaction takes its
+// descendants along, so they are what a high fee child can save it with.
+func (mp *Mempool) lowestFeeRate() string {
+	var lowest string
+	var lowestFee, lowestSize int
+	for id, e := range mp.txs {
+		fee, size := e.fee, e.size
+		for d := range mp.descendants(id) {
+			fee += mp.txs[d].fee
+			size += mp.txs[d].size
+		}
+		if lowest == "" || fee*lowestSize < lowestFee*size {
+			lowest, lowestFee, lowestSize = id, fee, size
+		}
+	}
+
+	return lowest
+}
+
+// Update follows the active chain to its new tip. Transactions confirmed
+// by connected blocks are dropped, as are those spending the same outputs
+// and their descendants. After a reorganization the transactions of the
+// disconnected blocks come back and every pending transaction is checked
+// again, since some may spend outputs that are gone. It must be called
+// with the chain at the new tip.
+func (mp *Mempool) Update(u UTXOSet, connected, disconnected []*Block, now time.Time) {
+	mp.mu.Lock()
+	for _, b := range connected {
+		for _, tx := range b.Transactions {
+			mp.remove(hex.EncodeToString(tx.ID))
+			for _, vin := range tx.Vin {
+				if other, ok := mp.spent[outpoint(vin.Txid, vin.Vout)]; ok {
+					mp.removeWithDescendants(other)
+				}
+			}
+		}
+	}
+	if len(disconnected) == 0 {
+		mp.mu.Unlock()
+		return
+	}
+
+	// Disconnected blocks come tip first, and their transactions go back
+	// before the pending ones, which may spend from them.
+	var txs []*Transaction
+	added := make(map[string]time.Time)
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if !tx.IsCoinbase() {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	for _, tx := range mp.sorted() {
+		id := hex.EncodeToString(tx.ID)
+		txs = append(txs, tx)
+		added[id] = mp.txs[id].added
+	}
+
+	mp.txs = make(map[string]*mempoolEntry)
+	mp.spent = make(map[string]string)
+	mp.size = 0
+	mp.mu.Unlock()
+
+	for _, tx := range txs {
+		t, ok := added[hex.EncodeToString(tx.ID)]
+		if !ok {
+			t = now
+		}
+		err := mp.Add(tx, u, t)
+		if err != nil {
+			fmt.Printf("Dropped transaction %x after reorganization: %s\n", tx.ID, err)
+		}
+	}
+}
+
+// Expire drops the transactions that have been waiting for longer than
+// the expiry, with their descendants, and returns how many went.
+func (mp *Mempool) Expire(now time.Time) int {
+	if mp.expiry == 0 {
+		return 0
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	expired := 0
+	for id, e := range mp.txs {
+		if mp.txs[id] != nil && now.Sub(e.added) > mp.expiry {
+			expired += len(mp.removeWithDescendants(id))
+		}
+	}
+
+	return expired
+}
+
+func (mp *Mempool) Get(id []byte) (*Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	e := mp.txs[hex.EncodeToString(id)]
+	if e == nil {
+		return nil, false
+	}
+
+	return e.tx, true
+}
+
+func (mp *Mempool) Has(id []byte) bool {
+	_, ok := mp.Get(id)
+
+	return ok
+}
+
+// Transactions returns the pending transactions, highest fee rate first
+// but parents before their children.
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.sorted()
+}
+
+func (mp *Mempool) sorted() []*Transaction {
+	var entries []*mempoolEntry
+	for _, e := range mp.txs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[j].feeRateBelow(entries[i])
+	})
+
+	var txs []*Transaction
+	for _, e := range entries {
+		txs = append(txs, e.tx)
+	}
+
+	return sortTopologically(txs)
+}
+
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return len(mp.txs)
+}
+
+// Size returns the serialized size of the pending transactions in bytes.
+func (mp *Mempool) Size() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.size
+}
+
+// savedTx is a pending transaction as Dump writes it.
+type savedTx struct {
+	Transaction []byte
+	Added       time.Time
+}
+
+// Dump writes the pending transactions to file, parents first, with the
+// time they were added. It writes a temporary file first and renames it, so
+// file is never left half written.
+func (mp *Mempool) Dump(file string) error {
+	mp.mu.Lock()
+	var saved []savedTx
+	for _, tx := range mp.sorted() {
+		saved = append(saved, savedTx{tx.Serialize(), mp.txs[hex.EncodeToString(tx.ID)].added})
+	}
+	mp.mu.Unlock()
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, content.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// Load admits the transactions Dump wrote to file that are still valid
+// against u and not expired, and returns how many there were. There is
+// nothing to load if the file does not exist. If file cannot be decoded,
+// nothing is admitted.
+func (mp *Mempool) Load(file string, u UTXOSet, now time.Time) (int, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var saved []savedTx
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&saved)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", file, err)
+	}
+
+	txs := make([]Transaction, len(saved))
+	for i, s := range saved {
+		err = gob.NewDecoder(bytes.NewReader(s.Transaction)).Decode(&txs[i])
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", file, err)
+		}
+	}
+
+	loaded := 0
+	for i, s := range saved {
+		tx := txs[i]
+		if mp.expiry > 0 && now.Sub(s.Added) > mp.expiry {
+			continue
+		}
+
+		err = mp.Add(&tx, u, s.Added)
+		if err != nil {
+			fmt.Printf("Dropped saved transaction %x: %s\n", tx.ID, err)
+			continue
+		}
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// honestTxReject reports whether a peer could have relayed a transaction
+// rejected with err in good faith: it may know blocks we do not have yet,
+// or have accepted a conflicting transaction first.
+func honestTxReject(err error) bool {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		return true
+	}
+
+	switch verr.Reason {
+	case RejectMissingInputs, RejectAlreadyKnown, RejectMempoolConflict, RejectMempoolFull, RejectTooLongChain,
+		RejectInsufficientFee, RejectTooManyReplacements:
+		return true
+	}
+
+	return false
+}
+
+func outpoint(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMempoolAdmission(t *testing.T) {
+	alice := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	mp := NewMempool(0, 0)
+	now := time.Now()
+
+	pay := NewUTXOTransaction(alice, bob, 3, 1, &u)
+	assert.NoError(t, mp.Add(pay, u, now))
+	assertRejected(t, RejectAlreadyKnown, mp.Add(pay, u, now))
+
+	doubleSpend := NewUTXOTransaction(alice, bob, 4, 2, &u)
+	err := mp.Add(doubleSpend, u, now)
+	assertRejected(t, RejectMempoolConflict, err)
+	assert.True(t, honestTxReject(err))
+
+	forged := *NewUTXOTransaction(alice, bob, 4, 2, &u)
+	forged.Vin = append([]TXInput{}, forged.Vin...)
+	forged.Vin[0].ScriptSig = append(Script{}, forged.Vin[0].ScriptSig...)
+	forged.Vin[0].ScriptSig[1] ^= 1
+	err = NewMempool(0, 0).Add(&forged, u, now)
+	assertRejected(t, RejectBadSignature, err)
+	assert.False(t, honestTxReject(err))
+
+	assertRejected(t, RejectLooseCoinbase, mp.Add(NewCoinbaseTX(bob, "", 1, 0), u, now))
+
+	assert.Equal(t, 1, mp.Count())
+	assert.Equal(t, len(pay.Serialize()), mp.Size())
+	got, ok := mp.Get(pay.ID)
+	assert.True(t, ok)
+	assert.Equal(t, pay, got)
+}
+
+func TestMempoolEvictsLowestFeeRate(t *testing.T) {
+	alice := NewWallet()
+	carol := NewWallet()
+	dave := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+
+	block1 := mineTestBlock(bc, genesis, string(carol.GetAddress()))
+	_, _, err := bc.AddBlock(block1)
+	assert.NoError(t, err)
+	_, _, err = bc.AddBlock(mineTestBlock(bc, block1, string(dave.GetAddress())))
+	assert.NoError(t, err)
+
+	low := NewUTXOTransaction(alice, bob, 2, 1, &u)
+	high := NewUTXOTransaction(carol, bob, 2, 5, &u)
+	mid := NewUTXOTransaction(dave, bob, 2, 3, &u)
+
+	size := len(high.Serialize())
+	if s := len(low.Serialize()); s > size {
+		size = s
+	}
+	mp := NewMempool(2*size, 0)
+	now := time.Now()
+
+	assert.NoError(t, mp.Add(low, u, now))
+	assert.NoError(t, mp.Add(high, u, now))
+	assert.NoError(t, mp.Add(mid, u, now))
+	assert.Equal(t, []*Transaction{high, mid}, mp.Transactions(), "Lowest fee rate is evicted")
+
+	err = mp.Add(low, u, now)
+	assertRejected(t, RejectMempoolFull, err)
+	assert.True(t, honestTxReject(err))
+	assert.False(t, mp.Has(low.ID))
+	assert.LessOrEqual(t, mp.Size(), 2*size)
+}
+
+func TestMempoolFollowsTheChain(t *testing.T) {
+	alice := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	miner := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+	mp := NewMempool(0, 0)
+	now := time.Now()
+
+	pending := NewUTXOTransaction(alice, bob, 3, 1, &u)
+	assert.NoError(t, mp.Add(pending, u, now))
+
+	// A block spending the same output knocks out the pending transaction.
+	conflicting := NewUTXOTransaction(alice, bob, 4, 1, &u)
+	a1 := mineTestBlock(bc, genesis, miner, conflicting)
+	connected, disconnected, err := bc.AddBlock(a1)
+	assert.NoError(t, err)
+	mp.Update(u, connected, disconnected, now)
+	assert.Equal(t, 0, mp.Count())
+
+	// Once that block is reorganized away, its transaction is pending again.
+	b1 := mineTestBlock(bc, genesis, miner)
+	_, _, err = bc.AddBlock(b1)
+	assert.NoError(t, err)
+	connected, disconnected, err = bc.AddBlock(mineTestBlock(bc, b1, miner))
+	assert.NoError(t, err)
+	mp.Update(u, connected, disconnected, now)
+	assert.Equal(t, []*Transaction{conflicting}, mp.Transactions())
+
+	// And confirming it again empties the pool.
+	block := mineTestBlock(bc, bc.mustGetBlock(bc.tip), miner, conflicting)
+	connected, disconnected, err = bc.AddBlock(block)
+	assert.NoError(t, err)
+	mp.Update(u, connected, disconnected, now)
+	assert.Equal(t, 0, mp.Count())
+	assert.Equal(t, 0, mp.Size())
+}
+
+func TestMempoolExpire(t *testing.T) {
+	alice := NewWallet()
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	mp := NewMempool(0, time.Hour)
+	now := time.Now()
+
+	assert.NoError(t, mp.Add(NewUTXOTransaction(alice, string(NewWallet().GetAddress()), 3, 1, &u), u, now))
+	assert.Equal(t, 0, mp.Expire(now.Add(30*time.Minute)))
+	assert.Equal(t, 1, mp.Expire(now.Add(time.Hour+time.Second)))
+	assert.Equal(t, 0, mp.Count())
+}
+
+func TestMempoolChainedTransactions(t *testing.T) {
+	alice := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	miner := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	mp := NewMempool(0, 0)
+	now := time.Now()
+
+	parent := NewUTXOTransaction(alice, bob, 3, 1, &u)
+	assert.NoError(t, mp.Add(parent, u, now))
+
+	// Only the pending change is left to spend.
+	child := NewTransaction(alice, bob, 2, 1, &u, mp.Transactions(), false)
+	assert.Equal(t, parent.ID, child.Vin[0].Txid)
+	_, confirmed := u.FindOutput(child.Vin[0].Txid, child.Vin[0].Vout)
+	assert.False(t, confirmed, "Parent is not on the chain")
+	assert.NoError(t, mp.Add(child, u, now))
+	assert.Equal(t, []*Transaction{parent, child}, mp.Transactions())
+
+	// Confirming the parent leaves the child pending.
+	block := mineTestBlock(bc, bc.mustGetBlock(bc.tip), miner, parent)
+	connected, disconnected, err := bc.AddBlock(block)
+	assert.NoError(t, err)
+	mp.Update(u, connected, disconnected, now)
+	assert.Equal(t, []*Transaction{child}, mp.Transactions())
+	_, confirmed = u.FindOutput(child.Vin[0].Txid, child.Vin[0].Vout)
+	assert.True(t, confirmed)
+
+	// Expiring a transaction takes its descendants along.
+	grandchild := NewTransaction(alice, bob, 1, 1, &u, mp.Transactions(), false)
+	assert.NoError(t, mp.Add(grandchild, u, now.Add(time.Minute)))
+	mp.expiry = time.Hour
+	assert.Equal(t, 2, mp.Expire(now.Add(time.Hour+time.Second)))
+	assert.Equal(t, 0, mp.Count())
+}
+
+func TestMempoolEvictsDependentChains(t *testing.T) {
+	alice := NewWallet()
+	carol := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	block1 := mineTestBlock(bc, bc.mustGetBlock(bc.tip), string(carol.GetAddress()))
+	_, _, err := bc.AddBlock(block1)
+	assert.NoError(t, err)
+
+	parent := NewUTXOTransaction(alice, bob, 2, 1, &u)
+	child := NewTransaction(alice, bob, 2, 3, &u, []*Transaction{parent}, false)
+	high := NewUTXOTransaction(carol, bob, 2, 5, &u)
+
+	mp := NewMempool(len(parent.Serialize())+len(child.Serialize())+len(high.Serialize())-1, 0)
+	now := time.Now()
+	assert.NoError(t, mp.Add(parent, u, now))
+	assert.NoError(t, mp.Add(child, u, now))
+	assert.NoError(t, mp.Add(high, u, now))
+	assert.Equal(t, []*Transaction{high}, mp.Transactions(), "Evicting the parent evicts the child")
+	assert.Equal(t, len(high.Serialize()), mp.Size())
+}
+
+func TestMempoolLimitsChainLength(t *testing.T) {
+	alice := NewWallet()
+	address := string(alice.GetAddress())
+	bc := newTestBlockchain(t, address)
+	u := UTXOSet{bc}
+	mp := NewMempool(0, 0)
+	now := time.Now()
+
+	// Each transaction passes the whole output of the one before on.
+	prev := NewUTXOTransaction(alice, address, 1, 1, &u)
+	next := func() *Transaction {
+		tx := &Transaction{nil, []TXInput{{prev.ID, 0, nil, 0}}, []TXOutput{prev.Vout[0]}}
+		tx.ID = tx.Hash()
+		tx.SignWithOutputs(alice.PrivateKey, prev.Vout[:1])
+		prev = tx
+		return tx
+	}
+	assert.NoError(t, mp.Add(prev, u, now))
+	for i := 0; i < maxMempoolAncestors; i++ {
+		assert.NoError(t, mp.Add(next(), u, now))
+	}
+
+	tx := next()
+	err := mp.Add(tx, u, now)
+	assertRejected(t, RejectTooLongChain, err)
+	assert.True(t, honestTxReject(err))
+}
+
+func TestMempoolReplaceByFee(t *testing.T) {
+	alice := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	mp := NewMempool(0, 0)
+	now := time.Now()
+
+	orig := NewTransaction(alice, bob, 3, 1, &u, nil, true)
+	assert.True(t, orig.Replaceable())
+	assert.NoError(t, mp.Add(orig, u, now))
+	child := NewTransaction(alice, bob, 1, 1, &u, mp.Transactions(), false)
+	assert.NoError(t, mp.Add(child, u, now))
+
+	coin, ok := u.FindOutput(orig.Vin[0].Txid, orig.Vin[0].Vout)
+	assert.True(t, ok)
+	prevOuts := []TXOutput{coin.Output}
+
+	_, err := NewFeeBump(alice, orig, prevOuts, 1)
+	assert.Error(t, err, "The fee has to go up")
+	_, err = NewFeeBump(alice, orig, prevOuts, chainParams.InitialSubsidy)
+	assert.Error(t, err, "Change cannot cover the fee")
+
+	// The replacement has to pay for the child it evicts too.
+	bump, err := NewFeeBump(alice, orig, prevOuts, 2)
+	assert.NoError(t, err)
+	err = mp.Add(bump, u, now)
+	assertRejected(t, RejectInsufficientFee, err)
+	assert.True(t, honestTxReject(err))
+
+	bump, err = NewFeeBump(alice, orig, prevOuts, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(bump, u, now))
+	assert.Equal(t, []*Transaction{bump}, mp.Transactions())
+	assert.Equal(t, len(bump.Serialize()), mp.Size())
+	assert.True(t, bump.Replaceable(), "A replacement can be bumped again")
+
+	// Transactions that did not opt in stay put.
+	final := NewMempool(0, 0)
+	assert.NoError(t, final.Add(NewUTXOTransaction(alice, bob, 3, 1, &u), u, now))
+	assertRejected(t, RejectMempoolConflict, final.Add(bump, u, now))
+}
+
+func TestMempoolDumpAndLoad(t *testing.T) {
+	alice := NewWallet()
+	carol := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	block1 := mineTestBlock(bc, bc.mustGetBlock(bc.tip), string(carol.GetAddress()))
+	_, _, err := bc.AddBlock(block1)
+	assert.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "mempool.dat")
+	n, err := NewMempool(0, 0).Load(file, u, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Nothing to load before the first dump")
+
+	mp := NewMempool(0, time.Hour)
+	now := time.Now()
+	parent := NewUTXOTransaction(alice, bob, 3, 1, &u)
+	assert.NoError(t, mp.Add(parent, u, now.Add(-30*time.Minute)))
+	child := NewTransaction(alice, bob, 2, 1, &u, mp.Transactions(), false)
+	assert.NoError(t, mp.Add(child, u, now.Add(-50*time.Minute)))
+	spent := NewUTXOTransaction(carol, bob, 3, 1, &u)
+	assert.NoError(t, mp.Add(spent, u, now))
+	assert.NoError(t, mp.Dump(file))
+
+	// While the node was down, a block spent carol's coins differently.
+	_, _, err = bc.AddBlock(mineTestBlock(bc, block1, bob, NewUTXOTransaction(carol, bob, 4, 1, &u)))
+	assert.NoError(t, err)
+
+	loaded := NewMempool(0, time.Hour)
+	n, err = loaded.Load(file, u, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []*Transaction{parent, child}, loaded.Transactions())
+
+	// The child keeps its age and expires with it.
+	assert.Equal(t, 1, loaded.Expire(now.Add(15*time.Minute)))
+	assert.Equal(t, []*Transaction{parent}, loaded.Transactions())
+
+	expired := NewMempool(0, time.Hour)
+	n, err = expired.Load(file, u, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// A dump cut short by a crash admits nothing.
+	content, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(file, content[:len(content)-10], 0644))
+	truncated := NewMempool(0, time.Hour)
+	n, err = truncated.Load(file, u, now)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.Zero(t, truncated.Count())
+
+	_, err = os.Stat(file + ".tmp")
+	assert.True(t, os.IsNotExist(err), "Dump leaves no temporary file behind")
+}
@@ -73,3 +73,33 @@ func TestNewMerkleTree(t *testing.T) {
 
 	assert.Equal(t, rootHash, fmt.Sprintf("%x", mTree.RootNode.Data), "Merkle tree root hash is correct")
 }
+
+func TestNewMerkleTreeOddLevel(t *testing.T) {
+	data := [][]byte{
+		[]byte("node1"),
+		[]byte("node2"),
+		[]byte("node3"),
+		[]byte("node4"),
+		[]byte("node5"),
+		[]byte("node6"),
+	}
+	n1 := NewMerkleNode(nil, nil, data[0])
+	n2 := NewMerkleNode(nil, nil, data[1])
+	n3 := NewMerkleNode(nil, nil, data[2])
+	n4 := NewMerkleNode(nil, nil, data[3])
+	n5 := NewMerkleNode(nil, nil, data[4])
+	n6 := NewMerkleNode(nil, nil, data[5])
+
+	n7 := NewMerkleNode(n1, n2, nil)
+	n8 := NewMerkleNode(n3, n4, nil)
+	n9 := NewMerkleNode(n5, n6, nil)
+
+	n10 := NewMerkleNode(n7, n8, nil)
+	n11 := NewMerkleNode(n9, n9, nil)
+
+	n12 := NewMerkleNode(n10, n11, nil)
+
+	mTree := NewMerkleTree(data)
+
+	assert.Equal(t, fmt.Sprintf("%x", n12.Data), fmt.Sprintf("%x", mTree.RootNode.Data), "Odd level is padded with its last node")
+}
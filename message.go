@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const messageHeaderLength = 4 + commandLength + 4 + 4
+const messageChecksumLength = 4
+const maxMessagePayload = 32 * 1024 * 1024
+
+var errBadMagic = errors.New("wrong network magic")
+var errBadCommand = errors.New("malformed command")
+var errMessageTooLarge = errors.New("message payload is too large")
+var errBadChecksum = errors.New("payload checksum mismatch")
+
+// message is a single frame on the wire: network magic, zero padded
+// command, payload length and payload checksum, followed by the payload.
+type message struct {
+	Command string
+	Payload []byte
+}
+
+// isFrameError reports whether err means the remote side sent a frame that
+// breaks the wire format, as opposed to the connection failing.
+func isFrameError(err error) bool {
+	return errors.Is(err, errBadMagic) || errors.Is(err, errBadCommand) ||
+		errors.Is(err, errMessageTooLarge) || errors.Is(err, errBadChecksum)
+}
+
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) > commandLength {
+		return errBadCommand
+	}
+	if len(payload) > maxMessagePayload {
+		return errMessageTooLarge
+	}
+
+	var frame bytes.Buffer
+	frame.Write(chainParams.NetworkMagic[:])
+	frame.Write(commandToBytes(command))
+	binary.Write(&frame, binary.LittleEndian, uint32(len(payload)))
+	frame.Write(payloadChecksum(payload))
+	frame.Write(payload)
+
+	_, err := w.Write(frame.Bytes())
+
+	return err
+}
+
+// readMessage reads the next frame from r. It returns io.EOF if r ends
+// cleanly between two messages.
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, messageHeaderLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], chainParams.NetworkMagic[:]) {
+		return nil, errBadMagic
+	}
+
+	rawCommand := header[4 : 4+commandLength]
+	command := bytesToCommand(rawCommand)
+	if len(command) == 0 || !bytes.Equal(commandToBytes(command), rawCommand) {
+		return nil, errBadCommand
+	}
+
+	length := binary.LittleEndian.Uint32(header[4+commandLength:])
+	if length > maxMessagePayload {
+		return nil, errMessageTooLarge
+	}
+
+	// The length comes from the remote side, so the payload buffer only
+	// grows as the bytes actually arrive instead of being allocated up
+	// front.
+	var payload bytes.Buffer
+	_, err = io.CopyN(&payload, r, int64(length))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("reading %s payload: %w", command, err)
+	}
+
+	if !bytes.Equal(header[4+commandLength+4:], payloadChecksum(payload.Bytes())) {
+		return nil, errBadChecksum
+	}
+
+	return &message{command, payload.Bytes()}, nil
+}
+
+func payloadChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:messageChecksumLength]
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMessageMultipleFrames(t *testing.T) {
+	var conn bytes.Buffer
+	writeMessage(&conn, "version", []byte("first"))
+	writeMessage(&conn, "getblocks", nil)
+
+	msg, err := readMessage(&conn)
+	assert.NoError(t, err)
+	assert.Equal(t, &message{"version", []byte("first")}, msg)
+
+	msg, err = readMessage(&conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "getblocks", msg.Command)
+	assert.Empty(t, msg.Payload)
+
+	_, err = readMessage(&conn)
+	assert.Equal(t, io.EOF, err, "Clean end between frames")
+}
+
+func TestReadMessageRejectsMalformedFrames(t *testing.T) {
+	frame := func() []byte {
+		var conn bytes.Buffer
+		writeMessage(&conn, "tx", []byte("payload"))
+		return conn.Bytes()
+	}
+
+	data := frame()
+	data[0] ^= 0xff
+	_, err := readMessage(bytes.NewReader(data))
+	assert.Equal(t, errBadMagic, err)
+
+	data = frame()
+	data[len(data)-1] ^= 0xff
+	_, err = readMessage(bytes.NewReader(data))
+	assert.Equal(t, errBadChecksum, err)
+
+	data = frame()
+	data[4+commandLength+3] = 0xff
+	_, err = readMessage(bytes.NewReader(data))
+	assert.Equal(t, errMessageTooLarge, err)
+
+	data = frame()
+	data[4+commandLength-1] = 'x'
+	_, err = readMessage(bytes.NewReader(data))
+	assert.Equal(t, errBadCommand, err)
+
+	data = frame()
+	_, err = readMessage(bytes.NewReader(data[:len(data)-2]))
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+	_, err = readMessage(bytes.NewReader(data[:5]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReadMessageAllocatesAsPayloadArrives(t *testing.T) {
+	var conn bytes.Buffer
+	writeMessage(&conn, "block", []byte("short"))
+	data := conn.Bytes()
+	binary.LittleEndian.PutUint32(data[4+commandLength:], maxMessagePayload)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readMessage(bytes.NewReader(data))
+	runtime.ReadMemStats(&after)
+
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20), "A claimed length alone does not allocate")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Miner keeps building blocks on top of the current tip from the mempool
+// in the background. Its current attempt is restarted whenever the tip or
+// the mempool changes.
+type Miner struct {
+	node      *Node
+	address   string
+	minTxs    int
+	mineEmpty bool
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	started bool
+	stopped bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func NewMiner(node *Node, address string, minTxs int, mineEmpty bool) *Miner {
+	return &Miner{
+		node:      node,
+		address:   address,
+		minTxs:    minTxs,
+		mineEmpty: mineEmpty,
+		cancel:    func() {},
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+func (m *Miner) Start() {
+	m.mu.Lock()
+	m.started = true
+	m.mu.Unlock()
+
+	go m.loop()
+}
+
+// Notify aborts the block being mined so that a new template is built.
+func (m *Miner) Notify() {
+	m.mu.Lock()
+	m.cancel()
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop aborts the block being mined and waits for the miner to finish
+// with the one it may be adding to the chain.
+func (m *Miner) Stop() {
+	m.mu.Lock()
+	m.stopped = true
+	started := m.started
+	m.mu.Unlock()
+
+	if !started {
+		return
+	}
+	m.Notify()
+	<-m.done
+}
+
+func (m *Miner) loop() {
+	defer close(m.done)
+
+	for {
+		m.mu.Lock()
+		if m.stopped {
+			m.mu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		m.cancel = cancel
+		m.mu.Unlock()
+
+		block := m.newTemplate()
+		if block == nil {
+			<-m.wake
+			continue
+		}
+
+		err := block.Mine(ctx)
+		cancel()
+		if err != nil {
+			fmt.Printf("Mining aborted: %s\n", err)
+			continue
+		}
+
+		err = m.node.processBlock(block, nil)
+		if err != nil {
+			fmt.Printf("Mined block %x was rejected: %s\n", block.Hash, err)
+			continue
+		}
+
+		fmt.Println("New block is mined!")
+	}
+}
+
+// newTemplate assembles the next block to mine, or returns nil when there
+// are not enough transactions in the mempool to bother.
+func (m *Miner) newTemplate() *Block {
+	candidates := m.node.MempoolTransactions()
+
+	m.node.chainMu.RLock()
+	defer m.node.chainMu.RUnlock()
+
+	bc := m.node.bc
+	UTXOSet := UTXOSet{bc}
+	txs, fees := UTXOSet.SelectTransactions(candidates)
+
+	if len(txs) < m.minTxs && !m.mineEmpty {
+		return nil
+	}
+
+	tip := bc.mustGetBlock(bc.tip)
+	cbTx := NewCoinbaseTX(m.address, "", tip.Height+1, fees)
+	txs = append([]*Transaction{cbTx}, txs...)
+
+	return bc.NewBlockTemplate(txs, tip)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinerTemplate(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	genesis := bc.mustGetBlock(bc.tip)
+
+	assert.Nil(t, NewMiner(NewNode(Config{}, bc), address, 1, false).newTemplate(), "Nothing to mine without transactions")
+
+	block := NewMiner(NewNode(Config{}, bc), address, 1, true).newTemplate()
+	if assert.NotNil(t, block) {
+		assert.Len(t, block.Transactions, 1)
+		assert.True(t, block.Transactions[0].IsCoinbase())
+		assert.Equal(t, genesis.Hash, block.PrevBlockHash)
+		assert.Equal(t, 1, block.Height)
+		assert.Equal(t, bc.NextBits(genesis), block.Bits)
+	}
+}
+
+func TestMinerStops(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	n := NewNode(Config{}, bc)
+	n.miner = NewMiner(n, address, 0, true)
+	n.miner.Start()
+
+	waitForHeight(t, 1, n)
+	n.Stop()
+
+	height := n.bestHeight()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, height, n.bestHeight(), "No block is mined after Stop")
+}
+
+func TestMinerStopsWithoutStarting(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	m := NewMiner(NewNode(Config{}, bc), address, 0, true)
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked on a miner that was never started")
+	}
+}
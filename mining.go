@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+const blockMaxSize = 1000000
+
+type feeTx struct {
+	tx   *Transaction
+	fee  int
+	size int
+
+	// parents are the indexes of the candidates tx spends from.
+	parents []int
+}
+
+// SelectTransactions picks the valid, non-conflicting candidates with the
+// highest fee rate first until the block is full. It returns them together
+// with the total fees they pay. Candidates may spend the outputs of other
+// candidates: those come first in the block, and a transaction is ranked
+// by the fee rate it pays together with the ones it needs.
+func (u UTXOSet) SelectTransactions(candidates []*Transaction) ([]*Transaction, int) {
+	var pool []*feeTx
+	height := u.Blockchain.GetBestHeight() + 1
+
+	// Parents are checked first so that their children can spend their
+	// outputs. Conflicts between candidates are sorted out below.
+	index := make(map[string]int)
+	created := make(map[string]UTXOEntry)
+	for _, tx := range sortTopologically(candidates) {
+		fee, err := u.checkTransactionInputs(tx, height, created)
+		if err != nil {
+			fmt.Printf("Skipping transaction %x: %s\n", tx.ID, err)
+			continue
+		}
+
+		entry := &feeTx{tx: tx, fee: fee, size: len(tx.Serialize())}
+		for _, vin := range tx.Vin {
+			if i, ok := index[hex.EncodeToString(vin.Txid)]; ok {
+				entry.parents = append(entry.parents, i)
+			}
+		}
+		index[hex.EncodeToString(tx.ID)] = len(pool)
+		pool = append(pool, entry)
+
+		for outIdx, out := range tx.Vout {
+			created[outpoint(tx.ID, outIdx)] = UTXOEntry{out, height, false}
+		}
+	}
+
+	packages := make([][]int, len(pool))
+	fees := make([]int, len(pool))
+	sizes := make([]int, len(pool))
+	order := make([]int, len(pool))
+	for i := range pool {
+		packages[i] = ancestorPackage(pool, i)
+		for _, j := range packages[i] {
+			fees[i] += pool[j].fee
+			sizes[i] += pool[j].size
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		return fees[i]*sizes[j] > fees[j]*sizes[i]
+	})
+
+	var selected []*Transaction
+	included := make(map[int]bool)
+	spent := make(map[string]bool)
+	size := 0
+	total := 0
+
+Candidates:
+	for _, i := range order {
+		var pkg []int
+		pkgSize := 0
+		pkgFee := 0
+		for _, j := range packages[i] {
+			if !included[j] {
+				pkg = append(pkg, j)
+				pkgSize += pool[j].size
+				pkgFee += pool[j].fee
+			}
+		}
+		if len(pkg) == 0 || size+pkgSize > blockMaxSize {
+			continue
+		}
+
+		inputs := make(map[string]bool)
+		for _, j := range pkg {
+			for _, vin := range pool[j].tx.Vin {
+				op := outpoint(vin.Txid, vin.Vout)
+				if spent[op] || inputs[op] {
+					continue Candidates
+				}
+				inputs[op] = true
+			}
+		}
+		for op := range inputs {
+			spent[op] = true
+		}
+
+		for _, j := range pkg {
+			included[j] = true
+			selected = append(selected, pool[j].tx)
+		}
+		size += pkgSize
+		total += pkgFee
+	}
+
+	return selected, total
+}
+
+// ancestorPackage returns candidate i with the candidates it depends on,
+// in the order they were checked, which puts parents first.
+func ancestorPackage(pool []*feeTx, i int) []int {
+	seen := map[int]bool{i: true}
+	stack := []int{i}
+	for len(stack) > 0 {
+		j := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, parent := range pool[j].parents {
+			if !seen[parent] {
+				seen[parent] = true
+				stack = append(stack, parent)
+			}
+		}
+	}
+
+	var pkg []int
+	for j := range seen {
+		pkg = append(pkg, j)
+	}
+	sort.Ints(pkg)
+
+	return pkg
+}
+
+// sortTopologically orders txs so that every transaction comes after the
+// ones in txs it spends from, keeping the given order otherwise.
+func sortTopologically(txs []*Transaction) []*Transaction {
+	byID := make(map[string]*Transaction)
+	for _, tx := range txs {
+		byID[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	var sorted []*Transaction
+	visited := make(map[string]bool)
+	var visit func(tx *Transaction)
+	visit = func(tx *Transaction) {
+		id := hex.EncodeToString(tx.ID)
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+
+		for _, vin := range tx.Vin {
+			if parent := byID[hex.EncodeToString(vin.Txid)]; parent != nil {
+				visit(parent)
+			}
+		}
+		sorted = append(sorted, tx)
+	}
+	for _, tx := range txs {
+		visit(tx)
+	}
+
+	return sorted
+}
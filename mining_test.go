@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectTransactionsByFeeRate(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+	carol := NewWallet()
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	UTXOSet := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+
+	block1 := mineTestBlock(bc, genesis, string(carol.GetAddress()))
+	_, _, err := bc.AddBlock(block1)
+	assert.NoError(t, err)
+
+	low := NewUTXOTransaction(alice, string(bob.GetAddress()), 2, 1, &UTXOSet)
+	high := NewUTXOTransaction(carol, string(bob.GetAddress()), 2, 3, &UTXOSet)
+	conflicting := NewUTXOTransaction(alice, string(bob.GetAddress()), 3, 2, &UTXOSet)
+
+	txs, fees := UTXOSet.SelectTransactions([]*Transaction{low, high, conflicting})
+	assert.Equal(t, []*Transaction{high, conflicting}, txs, "Highest fee rate wins a conflict")
+	assert.Equal(t, 5, fees)
+
+	block2 := bc.NewBlockTemplate(append([]*Transaction{NewCoinbaseTX(string(bob.GetAddress()), "", 2, fees+1)}, txs...), block1)
+	block2.Mine(context.Background())
+	_, _, err = bc.AddBlock(block2)
+	assertRejected(t, RejectBadCoinbaseAmount, err)
+
+	block2 = bc.NewBlockTemplate(append([]*Transaction{NewCoinbaseTX(string(bob.GetAddress()), "", 2, fees)}, txs...), block1)
+	block2.Mine(context.Background())
+	_, _, err = bc.AddBlock(block2)
+	assert.NoError(t, err)
+	assert.Equal(t, chainParams.InitialSubsidy+fees+2+3, testBalance(UTXOSet, bob))
+}
+
+func TestSelectTransactionsPutsParentsFirst(t *testing.T) {
+	alice := NewWallet()
+	carol := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+	block1 := mineTestBlock(bc, bc.mustGetBlock(bc.tip), string(carol.GetAddress()))
+	_, _, err := bc.AddBlock(block1)
+	assert.NoError(t, err)
+
+	parent := NewUTXOTransaction(alice, bob, 2, 1, &u)
+	child := NewTransaction(alice, bob, 2, 5, &u, []*Transaction{parent}, false)
+	mid := NewUTXOTransaction(carol, bob, 2, 2, &u)
+
+	// The child pays for its parent, which puts the pair ahead of mid.
+	txs, fees := u.SelectTransactions([]*Transaction{mid, child, parent})
+	assert.Equal(t, []*Transaction{parent, child, mid}, txs)
+	assert.Equal(t, 8, fees)
+
+	block2 := bc.NewBlockTemplate(append([]*Transaction{NewCoinbaseTX(bob, "", 2, fees)}, txs...), block1)
+	block2.Mine(context.Background())
+	_, _, err = bc.AddBlock(block2)
+	assert.NoError(t, err)
+
+	missing := NewUTXOTransaction(carol, bob, 1, 1, &u)
+	orphan := NewTransaction(carol, bob, 1, 1, &u, []*Transaction{missing}, false)
+	txs, _ = u.SelectTransactions([]*Transaction{orphan})
+	assert.Empty(t, txs, "A child without its parent is skipped")
+}
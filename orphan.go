@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const maxOrphanBlocks = 100
+const maxOrphansPerPeer = 20
+const orphanExpiry = 20 * time.Minute
+
+type orphanBlock struct {
+	block    *Block
+	from     *Peer
+	received time.Time
+}
+
+// OrphanPool keeps blocks whose parent is not known yet, indexed by the
+// hash of that missing parent.
+type OrphanPool struct {
+	mu       sync.Mutex
+	orphans  map[string]*orphanBlock
+	byParent map[string][]*orphanBlock
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		orphans:  make(map[string]*orphanBlock),
+		byParent: make(map[string][]*orphanBlock),
+	}
+}
+
+// Add stores block received from peer from. Expired orphans are dropped
+// first. If from already has maxOrphansPerPeer orphans its oldest one is
+// evicted, otherwise the oldest one overall when the pool is full.
+func (op *OrphanPool) Add(block *Block, from *Peer) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if op.orphans[hash] != nil {
+		return
+	}
+
+	now := time.Now()
+	var oldest, oldestFrom *orphanBlock
+	fromCount := 0
+	for _, orphan := range op.orphans {
+		if now.Sub(orphan.received) > orphanExpiry {
+			op.remove(orphan)
+			continue
+		}
+		if oldest == nil || orphan.received.Before(oldest.received) {
+			oldest = orphan
+		}
+		if orphan.from == from {
+			fromCount++
+			if oldestFrom == nil || orphan.received.Before(oldestFrom.received) {
+				oldestFrom = orphan
+			}
+		}
+	}
+	if fromCount >= maxOrphansPerPeer {
+		op.remove(oldestFrom)
+	} else if len(op.orphans) >= maxOrphanBlocks && oldest != nil {
+		op.remove(oldest)
+	}
+
+	orphan := &orphanBlock{block, from, now}
+	parent := hex.EncodeToString(block.PrevBlockHash)
+	op.orphans[hash] = orphan
+	op.byParent[parent] = append(op.byParent[parent], orphan)
+}
+
+func (op *OrphanPool) Has(hash []byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return op.orphans[hex.EncodeToString(hash)] != nil
+}
+
+func (op *OrphanPool) Count() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return len(op.orphans)
+}
+
+// MissingAncestor follows the chain of orphans starting at hash and returns
+// the hash of the first block that is not in the pool.
+func (op *OrphanPool) MissingAncestor(hash []byte) []byte {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	for {
+		orphan := op.orphans[hex.EncodeToString(hash)]
+		if orphan == nil {
+			return hash
+		}
+		hash = orphan.block.PrevBlockHash
+	}
+}
+
+// TakeChildren removes and returns the orphans waiting for parentHash,
+// along with the peers they came from.
+func (op *OrphanPool) TakeChildren(parentHash []byte) []*orphanBlock {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	children := append([]*orphanBlock{}, op.byParent[hex.EncodeToString(parentHash)]...)
+	for _, orphan := range children {
+		op.remove(orphan)
+	}
+
+	return children
+}
+
+func (op *OrphanPool) remove(orphan *orphanBlock) {
+	delete(op.orphans, hex.EncodeToString(orphan.block.Hash))
+
+	parent := hex.EncodeToString(orphan.block.PrevBlockHash)
+	siblings := op.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling == orphan {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(op.byParent, parent)
+	} else {
+		op.byParent[parent] = siblings
+	}
+}
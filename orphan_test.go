@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanPool(t *testing.T) {
+	pool := NewOrphanPool()
+	p1 := newPeer(nil, "p1", false)
+	p2 := newPeer(nil, "p2", false)
+	a := &Block{Hash: []byte{1}, PrevBlockHash: []byte{0}}
+	b := &Block{Hash: []byte{2}, PrevBlockHash: []byte{1}}
+	c := &Block{Hash: []byte{3}, PrevBlockHash: []byte{1}}
+
+	pool.Add(b, p1)
+	pool.Add(c, p1)
+	pool.Add(a, p2)
+	assert.Equal(t, 3, pool.Count())
+	assert.Equal(t, []byte{0}, pool.MissingAncestor(b.PrevBlockHash), "Missing ancestor is behind the chain of orphans")
+
+	children := pool.TakeChildren([]byte{0})
+	if assert.Len(t, children, 1) {
+		assert.Equal(t, a, children[0].block)
+		assert.Equal(t, p2, children[0].from)
+	}
+	assert.Len(t, pool.TakeChildren([]byte{1}), 2)
+	assert.Equal(t, 0, pool.Count())
+}
+
+func TestOrphanPoolEvictsOldest(t *testing.T) {
+	pool := NewOrphanPool()
+
+	for i := 0; i <= maxOrphanBlocks; i++ {
+		pool.Add(&Block{Hash: []byte{byte(i), 1}, PrevBlockHash: []byte{byte(i)}}, newPeer(nil, "p", false))
+	}
+
+	assert.Equal(t, maxOrphanBlocks, pool.Count())
+	assert.False(t, pool.Has([]byte{0, 1}), "Oldest orphan is evicted")
+	assert.True(t, pool.Has([]byte{maxOrphanBlocks, 1}))
+}
+
+func TestOrphanPoolLimitsOrphansPerPeer(t *testing.T) {
+	pool := NewOrphanPool()
+	other := newPeer(nil, "other", false)
+	flooder := newPeer(nil, "flooder", false)
+
+	pool.Add(&Block{Hash: []byte{0, 0}, PrevBlockHash: []byte{0}}, other)
+	for i := 1; i <= maxOrphansPerPeer+1; i++ {
+		pool.Add(&Block{Hash: []byte{byte(i), 1}, PrevBlockHash: []byte{byte(i)}}, flooder)
+	}
+
+	assert.Equal(t, maxOrphansPerPeer+1, pool.Count())
+	assert.False(t, pool.Has([]byte{1, 1}), "The peer's own oldest orphan makes room")
+	assert.True(t, pool.Has([]byte{0, 0}), "Other peers' orphans are kept")
+}
@@ -0,0 +1,31 @@
+package main
+
+type ChainParams struct {
+	InitialBits        int
+	MinBits            int
+	MaxBits            int
+	RetargetInterval   int
+	TargetSpacing      int64
+	MaxRetargetFactor  int64
+	InitialSubsidy     int
+	HalvingInterval    int
+	CoinbaseMaturity   int
+	MedianTimeSpan     int
+	MaxFutureBlockTime int64
+	NetworkMagic       [4]byte
+}
+
+var chainParams = ChainParams{
+	InitialBits:        24,
+	MinBits:            16,
+	MaxBits:            240,
+	RetargetInterval:   10,
+	TargetSpacing:      30,
+	MaxRetargetFactor:  4,
+	InitialSubsidy:     10,
+	HalvingInterval:    1000,
+	CoinbaseMaturity:   10,
+	MedianTimeSpan:     11,
+	MaxFutureBlockTime: 2 * 60 * 60,
+	NetworkMagic:       [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+}
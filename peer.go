@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const minProtocolVersion = 2
+const nodeServices uint64 = 1
+const outboundQueueSize = 256
+const handshakeTimeout = 10 * time.Second
+const dialTimeout = 5 * time.Second
+
+var pingInterval = 2 * time.Minute
+var pingTimeout = 30 * time.Second
+
+var errSelfConnection = errors.New("connected to self")
+var errObsoletePeer = errors.New("peer protocol version is too old")
+var errUnexpectedHandshake = errors.New("unexpected message during handshake")
+
+// Peer is a long-lived connection to another node. Messages are written by
+// a dedicated goroutine draining the outbound queue, so Send never blocks
+// on the network. A peer is known by the address of the connection: the
+// one we dialled, or the remote address of an inbound connection.
+type Peer struct {
+	conn     net.Conn
+	addr     string
+	inbound  bool
+	version  version
+	outbound chan *message
+	quit     chan struct{}
+	once     sync.Once
+
+	mu        sync.Mutex
+	banScore  int
+	connected time.Time
+	lastRecv  time.Time
+	pingNonce uint64
+	pingSent  time.Time
+	latency   time.Duration
+}
+
+// PeerInfo is a snapshot of a peer's state for display.
+type PeerInfo struct {
+	Address     string
+	ListenAddr  string
+	Inbound     bool
+	Version     int
+	BestHeight  int
+	BanScore    int
+	ConnectedAt time.Time
+	LastRecv    time.Time
+	Latency     time.Duration
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		conn:      conn,
+		addr:      addr,
+		inbound:   inbound,
+		outbound:  make(chan *message, outboundQueueSize),
+		quit:      make(chan struct{}),
+		connected: time.Now(),
+	}
+}
+
+// ip returns the IP address the peer connects from, which is what bans
+// apply to.
+func (p *Peer) ip() string {
+	return remoteIP(p.conn)
+}
+
+// local reports whether the peer connects from this machine.
+func (p *Peer) local() bool {
+	ip := net.ParseIP(p.ip())
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// cli reports whether the peer is a command line session on this machine
+// rather than a node. Nodes always tell their address in the version, and
+// the command line never does.
+func (p *Peer) cli() bool {
+	return p.inbound && p.local() && p.version.AddrFrom == ""
+}
+
+// remoteIP returns the IP address at the other end of conn.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+func (p *Peer) String() string {
+	return p.addr
+}
+
+// listenAddr returns the address the peer accepts connections at, or ""
+// if it does not listen. For an inbound peer this is only what it claims
+// in its version, so it is good for gossip but not to identify the peer.
+func (p *Peer) listenAddr() string {
+	if !p.inbound {
+		return p.addr
+	}
+
+	return p.version.AddrFrom
+}
+
+// Send queues a message for the peer. A peer that lets its queue fill up
+// is too slow to keep and gets disconnected.
+func (p *Peer) Send(command string, payload []byte) {
+	select {
+	case p.outbound <- &message{command, payload}:
+	case <-p.quit:
+	default:
+		fmt.Printf("Outbound queue to %s is full, disconnecting\n", p)
+		p.Close()
+	}
+}
+
+// addBanScore raises the peer's misbehavior score by points and returns
+// the new total.
+func (p *Peer) addBanScore(points int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.banScore += points
+
+	return p.banScore
+}
+
+// nextPing returns the nonce of a ping to send at now, or false if the last
+// ping is still unanswered or was sent less than pingInterval ago.
+func (p *Peer) nextPing(now time.Time) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce != 0 || now.Sub(p.pingSent) < pingInterval {
+		return 0, false
+	}
+
+	for p.pingNonce == 0 {
+		p.pingNonce = rand.Uint64()
+	}
+	p.pingSent = now
+
+	return p.pingNonce, true
+}
+
+// pingTimedOut reports whether the last ping has gone unanswered for longer
+// than pingTimeout.
+func (p *Peer) pingTimedOut(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pingNonce != 0 && now.Sub(p.pingSent) > pingTimeout
+}
+
+// pongReceived measures the round trip of the ping answered by nonce and
+// reports whether it was the one outstanding.
+func (p *Peer) pongReceived(nonce uint64, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if nonce == 0 || nonce != p.pingNonce {
+		return false
+	}
+	p.latency = now.Sub(p.pingSent)
+	p.pingNonce = 0
+
+	return true
+}
+
+func (p *Peer) Info() PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PeerInfo{
+		Address:     p.addr,
+		ListenAddr:  p.listenAddr(),
+		Inbound:     p.inbound,
+		Version:     p.version.Version,
+		BestHeight:  p.version.BestHeight,
+		BanScore:    p.banScore,
+		ConnectedAt: p.connected,
+		LastRecv:    p.lastRecv,
+		Latency:     p.latency,
+	}
+}
+
+// Close shuts the connection down. It is safe to call more than once.
+func (p *Peer) Close() {
+	p.once.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// Done is closed once the peer has been disconnected.
+func (p *Peer) Done() <-chan struct{} {
+	return p.quit
+}
+
+// handshake exchanges version and verack with the remote side. Both sides
+// send their version straight away and acknowledge the other's version
+// once it has been checked.
+func (p *Peer) handshake(ours version) error {
+	p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	err := writeMessage(p.conn, "version", gobEncode(ours))
+	if err != nil {
+		return err
+	}
+
+	gotVersion := false
+	for {
+		msg, err := readMessage(p.conn)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case msg.Command == "version" && !gotVersion:
+			dec := gob.NewDecoder(bytes.NewReader(msg.Payload))
+			err = dec.Decode(&p.version)
+			if err != nil {
+				return err
+			}
+			if p.version.Nonce == ours.Nonce {
+				return errSelfConnection
+			}
+			if p.version.Version < minProtocolVersion {
+				return errObsoletePeer
+			}
+
+			err = writeMessage(p.conn, "verack", nil)
+			if err != nil {
+				return err
+			}
+			gotVersion = true
+		case msg.Command == "verack" && gotVersion:
+			return nil
+		default:
+			return fmt.Errorf("%w: %s", errUnexpectedHandshake, msg.Command)
+		}
+	}
+}
+
+// run starts the write goroutine and reads messages on the calling
+// goroutine until the connection ends, passing each one to handle. It
+// returns the error that ended a connection that was not closed cleanly.
+func (p *Peer) run(handle func(*Peer, *message)) error {
+	go p.writeLoop()
+	defer p.Close()
+
+	for {
+		msg, err := readMessage(p.conn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			select {
+			case <-p.quit:
+				return nil
+			default:
+				fmt.Printf("Dropping connection to %s: %s\n", p, err)
+				return err
+			}
+		}
+
+		p.mu.Lock()
+		p.lastRecv = time.Now()
+		p.mu.Unlock()
+
+		handle(p, msg)
+	}
+}
+
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.outbound:
+			err := writeMessage(p.conn, msg.Command, msg.Payload)
+			if err != nil {
+				fmt.Printf("Sending %s to %s failed: %s\n", msg.Command, p, err)
+				p.Close()
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// PeerManager keeps track of the peers that have completed the handshake.
+type PeerManager struct {
+	mu    sync.Mutex
+	peers map[string]*Peer
+}
+
+func NewPeerManager() *PeerManager {
+	return &PeerManager{peers: make(map[string]*Peer)}
+}
+
+// Add registers p and reports false if a peer with the same address is
+// already connected.
+func (pm *PeerManager) Add(p *Peer) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if _, ok := pm.peers[p.addr]; ok {
+		return false
+	}
+	pm.peers[p.addr] = p
+
+	return true
+}
+
+// Remove forgets p, leaving any newer peer with the same address alone.
+func (pm *PeerManager) Remove(p *Peer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.peers[p.addr] == p {
+		delete(pm.peers, p.addr)
+	}
+}
+
+func (pm *PeerManager) Get(addr string) *Peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return pm.peers[addr]
+}
+
+func (pm *PeerManager) Peers() []*Peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var peers []*Peer
+	for _, p := range pm.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+func (pm *PeerManager) Count() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return len(pm.peers)
+}
+
+// InboundCount returns how many of the peers connected to us.
+func (pm *PeerManager) InboundCount() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	count := 0
+	for _, p := range pm.peers {
+		if p.inbound {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Broadcast queues a message for every peer except skip.
+func (pm *PeerManager) Broadcast(command string, payload []byte, skip *Peer) {
+	for _, p := range pm.Peers() {
+		if p != skip {
+			p.Send(command, payload)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPeerPair returns both ends of a loopback TCP connection wrapped as
+// peers.
+func testPeerPair(t *testing.T) (*Peer, *Peer) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial(protocol, ln.Addr().String())
+	assert.NoError(t, err)
+
+	out := newPeer(conn, ln.Addr().String(), false)
+	in := newPeer(<-accepted, conn.LocalAddr().String(), true)
+	t.Cleanup(func() {
+		out.Close()
+		in.Close()
+	})
+
+	return out, in
+}
+
+func TestHandshake(t *testing.T) {
+	out, in := testPeerPair(t)
+
+	errs := make(chan error)
+	go func() {
+		errs <- in.handshake(version{nodeVersion, nodeServices, 7, "", 1})
+	}()
+	assert.NoError(t, out.handshake(version{nodeVersion, nodeServices, 3, "", 2}))
+	assert.NoError(t, <-errs)
+
+	assert.Equal(t, 7, out.version.BestHeight)
+	assert.Equal(t, 3, in.version.BestHeight)
+	assert.Equal(t, nodeVersion, out.version.Version)
+	assert.Equal(t, nodeServices, in.version.Services)
+}
+
+func TestHandshakeDetectsSelfConnection(t *testing.T) {
+	out, in := testPeerPair(t)
+
+	errs := make(chan error)
+	go func() {
+		errs <- in.handshake(version{nodeVersion, nodeServices, 0, "", 1})
+	}()
+	err := out.handshake(version{nodeVersion, nodeServices, 0, "", 1})
+	assert.True(t, errors.Is(err, errSelfConnection))
+
+	out.Close()
+	assert.Error(t, <-errs)
+}
+
+func TestPeerSendAndReceive(t *testing.T) {
+	out, in := testPeerPair(t)
+
+	received := make(chan *message, 1)
+	go in.run(func(p *Peer, msg *message) {
+		received <- msg
+	})
+	go out.run(func(p *Peer, msg *message) {})
+
+	out.Send("getblocks", gobEncode(getblocks{}))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "getblocks", msg.Command)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	out.Close()
+	select {
+	case <-in.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote close was not noticed")
+	}
+}
+
+func TestPeerManager(t *testing.T) {
+	out, in := testPeerPair(t)
+	pm := NewPeerManager()
+
+	assert.True(t, pm.Add(out))
+	assert.False(t, pm.Add(newPeer(nil, out.addr, false)), "Duplicate address")
+	assert.True(t, pm.Add(in))
+	assert.Equal(t, 2, pm.Count())
+	assert.Equal(t, out, pm.Get(out.addr))
+
+	pm.Remove(out)
+	assert.Nil(t, pm.Get(out.addr))
+	assert.Equal(t, 1, pm.Count())
+}
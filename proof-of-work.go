@@ -2,23 +2,33 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"math"
 	"math/big"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const targetBits = 24
+const hashrateInterval = 10 * time.Second
+
+var maxNonce = math.MaxInt64
+var miningThreads = runtime.NumCPU()
 
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
 }
 
+// NewProofOfWork computes the target of b from its difficulty bits, clamped
+// to the allowed range so a malformed header cannot request a huge shift.
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-clampBits(b.Bits)))
 
 	pow := &ProofOfWork{b, target}
 
@@ -26,13 +36,17 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return append(pow.prepareHeader(), IntToHex(int64(nonce))...)
+}
+
+// prepareHeader returns the hashed header fields that precede the nonce.
+func (pow *ProofOfWork) prepareHeader() []byte {
 	data := bytes.Join(
 		[][]byte{
 			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
+			pow.block.MerkleRoot,
 			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
-			IntToHex(int64(nonce)),
+			IntToHex(int64(pow.block.Bits)),
 		},
 		[]byte{},
 	)
@@ -40,41 +54,171 @@ func (pow *ProofOfWork) prepareData(nonce int) []byte {
 	return data
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
-
-	fmt.Printf("Mining a new block")
-	for nonce < math.MaxInt64 {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash)
-		hashInt.SetBytes(hash[:])
-
-		if hashInt.Cmp(pow.target) == -1 {
-			break
-		} else {
-			nonce++
+// Run searches for a nonce that brings the block hash below the target,
+// splitting the nonce space between workers goroutines. When the whole
+// space is exhausted the block timestamp is rolled forward and the search
+// starts over. It gives up with ctx.Err() once ctx is cancelled.
+func (pow *ProofOfWork) Run(ctx context.Context, workers int) (int, []byte, error) {
+	var hashes int64
+	start := time.Now()
+
+	if workers < 1 {
+		workers = 1
+	}
+	fmt.Printf("Mining a new block with %d workers\n", workers)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(hashrateInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("Hashrate: %s\n", formatHashrate(atomic.LoadInt64(&hashes), time.Since(start)))
+			case <-done:
+				return
+			}
 		}
+	}()
+
+	for {
+		nonce, hash, found := pow.search(ctx, workers, &hashes)
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+
+		if found {
+			fmt.Printf("Found %x after %s at %s\n", hash, time.Since(start).Round(time.Millisecond), formatHashrate(atomic.LoadInt64(&hashes), time.Since(start)))
+			return nonce, hash, nil
+		}
+
+		pow.block.Timestamp++
+	}
+}
+
+// search tries every nonce up to maxNonce for the current header. Worker i
+// checks nonces i, i+workers, i+2*workers and so on.
+func (pow *ProofOfWork) search(ctx context.Context, workers int, hashes *int64) (int, []byte, bool) {
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	header := pow.prepareHeader()
+	solutions := make(chan solution, workers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(first int) {
+			defer wg.Done()
+
+			var hashInt big.Int
+			data := append([]byte{}, header...)
+
+			for nonce, i := first, 0; nonce >= 0 && nonce <= maxNonce; nonce, i = nonce+workers, i+1 {
+				if i%1024 == 0 {
+					if ctx.Err() != nil {
+						return
+					}
+					atomic.AddInt64(hashes, 1024)
+				}
+
+				data = append(data[:len(header)], IntToHex(int64(nonce))...)
+				hash := sha256.Sum256(data)
+				hashInt.SetBytes(hash[:])
+
+				if hashInt.Cmp(pow.target) == -1 {
+					solutions <- solution{nonce, hash[:]}
+					cancel()
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	select {
+	case s := <-solutions:
+		return s.nonce, s.hash, true
+	default:
+		return 0, nil, false
+	}
+}
+
+func formatHashrate(hashes int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "0 H/s"
 	}
-	fmt.Print("\n\n")
 
-	return nonce, hash[:]
+	return fmt.Sprintf("%.0f H/s", float64(hashes)/elapsed.Seconds())
 }
 
 func IntToHex(in int64) []byte {
 	return []byte(strconv.FormatInt(int64(in), 16))
 }
 
-func (pow *ProofOfWork) Validate() bool {
+// Hash computes the header hash of the block with its current nonce.
+func (pow *ProofOfWork) Hash() []byte {
+	hash := sha256.Sum256(pow.prepareData(pow.block.Nonce))
+
+	return hash[:]
+}
+
+func (pow *ProofOfWork) Validate(requiredBits int) bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
+	if pow.block.Bits != requiredBits {
+		return false
+	}
+
+	hashInt.SetBytes(pow.Hash())
 
 	isValid := hashInt.Cmp(pow.target) == -1
 
 	return isValid
 }
+
+// retargetBits adjusts the difficulty by the rounded log2 of how far the
+// observed timespan of the last window drifted from the expected one.
+func retargetBits(bits int, actualTimespan int64) int {
+	expectedTimespan := chainParams.TargetSpacing * int64(chainParams.RetargetInterval-1)
+
+	if actualTimespan < expectedTimespan/chainParams.MaxRetargetFactor {
+		actualTimespan = expectedTimespan / chainParams.MaxRetargetFactor
+	}
+	if actualTimespan > expectedTimespan*chainParams.MaxRetargetFactor {
+		actualTimespan = expectedTimespan * chainParams.MaxRetargetFactor
+	}
+	if actualTimespan < 1 {
+		actualTimespan = 1
+	}
+
+	shift := math.Round(math.Log2(float64(expectedTimespan) / float64(actualTimespan)))
+
+	return clampBits(bits + int(shift))
+}
+
+// clampBits limits bits to the range between MinBits and MaxBits.
+func clampBits(bits int) int {
+	if bits < chainParams.MinBits {
+		return chainParams.MinBits
+	}
+	if bits > chainParams.MaxBits {
+		return chainParams.MaxBits
+	}
+
+	return bits
+}
+
+// blockWork is the expected number of hashes needed to mine a block with
+// the given difficulty bits, clamped to the allowed range.
+func blockWork(bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(clampBits(bits)))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetargetBits(t *testing.T) {
+	expected := chainParams.TargetSpacing * int64(chainParams.RetargetInterval-1)
+
+	assert.Equal(t, 20, retargetBits(20, expected), "On schedule keeps difficulty")
+	assert.Equal(t, 21, retargetBits(20, expected/2), "Twice as fast adds a bit")
+	assert.Equal(t, 19, retargetBits(20, expected*2), "Twice as slow removes a bit")
+	assert.Equal(t, 22, retargetBits(20, 0), "Speedup is clamped")
+	assert.Equal(t, 18, retargetBits(20, expected*100), "Slowdown is clamped")
+	assert.Equal(t, chainParams.MinBits, retargetBits(chainParams.MinBits, expected*4), "Difficulty never drops below the limit")
+}
+
+func TestProofOfWorkValidate(t *testing.T) {
+	block := &Block{Timestamp: 1, PrevBlockHash: []byte{}, Bits: 8}
+	block.Transactions = []*Transaction{NewCoinbaseTX("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "test", 0, 0)}
+	nonce, hash, err := NewProofOfWork(block).Run(context.Background(), 4)
+	assert.NoError(t, err)
+	block.Nonce = nonce
+	block.Hash = hash
+
+	assert.True(t, NewProofOfWork(block).Validate(8), "Mined block satisfies its own bits")
+	assert.False(t, NewProofOfWork(block).Validate(9), "Block with wrong bits is rejected")
+}
+
+func TestProofOfWorkRunRollsTimestampAndCancels(t *testing.T) {
+	defer func(n int) { maxNonce = n }(maxNonce)
+	maxNonce = 16
+
+	block := &Block{Timestamp: 1, PrevBlockHash: []byte{}, Bits: 64}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := NewProofOfWork(block).Run(ctx, 4)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, block.Timestamp > 1, "Timestamp is rolled once the nonce space is exhausted")
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Opcodes of the script language. Bytes 1 to 75 are not listed: each
+// pushes that many of the bytes following it.
+const (
+	OpFalse          = 0x00
+	OpPushData1      = 0x4c
+	OpTrue           = 0x51
+	OpIf             = 0x63
+	OpNotIf          = 0x64
+	OpElse           = 0x67
+	OpEndIf          = 0x68
+	OpVerify         = 0x69
+	OpReturn         = 0x6a
+	OpDrop           = 0x75
+	OpDup            = 0x76
+	OpEqual          = 0x87
+	OpEqualVerify    = 0x88
+	OpSha256         = 0xa8
+	OpHash160        = 0xa9
+	OpCheckSig       = 0xac
+	OpCheckSigVerify = 0xad
+)
+
+const maxDirectPush = 0x4b
+const maxScriptSize = 10000
+const maxScriptElementSize = 520
+const maxStackSize = 1000
+
+var opNames = map[byte]string{
+	OpFalse:          "OP_FALSE",
+	OpPushData1:      "OP_PUSHDATA1",
+	OpTrue:           "OP_TRUE",
+	OpIf:             "OP_IF",
+	OpNotIf:          "OP_NOTIF",
+	OpElse:           "OP_ELSE",
+	OpEndIf:          "OP_ENDIF",
+	OpVerify:         "OP_VERIFY",
+	OpReturn:         "OP_RETURN",
+	OpDrop:           "OP_DROP",
+	OpDup:            "OP_DUP",
+	OpEqual:          "OP_EQUAL",
+	OpEqualVerify:    "OP_EQUALVERIFY",
+	OpSha256:         "OP_SHA256",
+	OpHash160:        "OP_HASH160",
+	OpCheckSig:       "OP_CHECKSIG",
+	OpCheckSigVerify: "OP_CHECKSIGVERIFY",
+}
+
+// Script is a program in the stack-based script language. An output is
+// locked by a script, and an input spending it provides an unlocking
+// script that only pushes data. The input may spend the output if running
+// both, the unlocking script first and on the same stack, leaves true on
+// top.
+type Script []byte
+
+// AddOp appends opcode op to s.
+func (s Script) AddOp(op byte) Script {
+	return append(s, op)
+}
+
+// AddData appends the opcode that pushes data, followed by data.
+func (s Script) AddData(data []byte) Script {
+	if len(data) > maxDirectPush {
+		s = append(s, OpPushData1, byte(len(data)))
+	} else {
+		s = append(s, byte(len(data)))
+	}
+
+	return append(s, data...)
+}
+
+// scriptOp is an opcode of a script with the data it pushes, if any.
+type scriptOp struct {
+	code byte
+	data []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.code <= OpPushData1
+}
+
+// parse splits s into its opcodes.
+func (s Script) parse() ([]scriptOp, error) {
+	if len(s) > maxScriptSize {
+		return nil, fmt.Errorf("script is %d bytes long, at most %d are allowed", len(s), maxScriptSize)
+	}
+
+	var ops []scriptOp
+	for pc := 0; pc < len(s); {
+		code := s[pc]
+		pc++
+
+		size := 0
+		switch {
+		case code >= 1 && code <= maxDirectPush:
+			size = int(code)
+		case code == OpPushData1:
+			if pc >= len(s) {
+				return nil, errors.New("script ends in the middle of a push")
+			}
+			size = int(s[pc])
+			pc++
+		}
+		if pc+size > len(s) {
+			return nil, errors.New("script ends in the middle of a push")
+		}
+
+		ops = append(ops, scriptOp{code, s[pc : pc+size]})
+		pc += size
+	}
+
+	return ops, nil
+}
+
+// IsPushOnly reports whether s does nothing but push data.
+func (s Script) IsPushOnly() bool {
+	ops, err := s.parse()
+	if err != nil {
+		return false
+	}
+
+	for _, op := range ops {
+		if !op.isPush() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Script) String() string {
+	ops, err := s.parse()
+	if err != nil {
+		return fmt.Sprintf("[invalid %x]", []byte(s))
+	}
+
+	var words []string
+	for _, op := range ops {
+		name, known := opNames[op.code]
+		switch {
+		case op.code != OpFalse && op.isPush():
+			words = append(words, hex.EncodeToString(op.data))
+		case known:
+			words = append(words, name)
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN%d", op.code))
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// P2PKHScript is the standard locking script paying to the owner of the
+// key hashing to pubKeyHash:
+//
+//	OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func P2PKHScript(pubKeyHash []byte) Script {
+	return Script{}.AddOp(OpDup).AddOp(OpHash160).AddData(pubKeyHash).AddOp(OpEqualVerify).AddOp(OpCheckSig)
+}
+
+// P2PKHUnlockingScript spends an output locked with P2PKHScript:
+//
+//	<signature> <pubKey>
+func P2PKHUnlockingScript(signature, pubKey []byte) Script {
+	return Script{}.AddData(signature).AddData(pubKey)
+}
+
+// PubKeyHash returns the key hash s pays to if it is a P2PKHScript.
+func (s Script) PubKeyHash() ([]byte, bool) {
+	ops, err := s.parse()
+	if err != nil || len(ops) != 5 ||
+		ops[0].code != OpDup || ops[1].code != OpHash160 || !ops[2].isPush() ||
+		ops[3].code != OpEqualVerify || ops[4].code != OpCheckSig {
+		return nil, false
+	}
+
+	return ops[2].data, true
+}
+
+// P2PKHPubKey returns the public key s provides if it is a
+// P2PKHUnlockingScript.
+func (s Script) P2PKHPubKey() ([]byte, bool) {
+	ops, err := s.parse()
+	if err != nil || len(ops) != 2 || !ops[0].isPush() || !ops[1].isPush() {
+		return nil, false
+	}
+
+	return ops[1].data, true
+}
+
+// VerifyScript runs unlocking and then locking on the same stack and
+// returns an error unless that succeeds and leaves true on top. checkSig
+// tells whether a signature by a public key is valid for the spending
+// input.
+func VerifyScript(unlocking, locking Script, checkSig func(signature, pubKey []byte) bool) error {
+	if !unlocking.IsPushOnly() {
+		return errors.New("unlocking script does more than push data")
+	}
+
+	vm := scriptVM{checkSig: checkSig}
+	err := vm.run(unlocking)
+	if err != nil {
+		return err
+	}
+	err = vm.run(locking)
+	if err != nil {
+		return err
+	}
+
+	if len(vm.stack) == 0 || !asBool(vm.stack[len(vm.stack)-1]) {
+		return errors.New("script did not leave true on the stack")
+	}
+
+	return nil
+}
+
+// scriptVM is the state of a running script.
+type scriptVM struct {
+	stack    [][]byte
+	checkSig func(signature, pubKey []byte) bool
+}
+
+func (vm *scriptVM) push(data []byte) error {
+	if len(data) > maxScriptElementSize {
+		return fmt.Errorf("pushing %d bytes, at most %d are allowed", len(data), maxScriptElementSize)
+	}
+	if len(vm.stack) >= maxStackSize {
+		return errors.New("stack overflow")
+	}
+	vm.stack = append(vm.stack, data)
+
+	return nil
+}
+
+func (vm *scriptVM) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+
+	return top, nil
+}
+
+func (vm *scriptVM) run(s Script) error {
+	ops, err := s.parse()
+	if err != nil {
+		return err
+	}
+
+	// branches holds, for each OP_IF entered, whether its current branch
+	// runs. Opcodes only run if every enclosing branch does.
+	var branches []bool
+	running := func() bool {
+		for _, b := range branches {
+			if !b {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		switch op.code {
+		case OpIf, OpNotIf:
+			taken := false
+			if running() {
+				cond, err := vm.pop()
+				if err != nil {
+					return err
+				}
+				taken = asBool(cond) == (op.code == OpIf)
+			}
+			branches = append(branches, taken)
+			continue
+		case OpElse:
+			if len(branches) == 0 {
+				return errors.New("OP_ELSE without OP_IF")
+			}
+			branches[len(branches)-1] = !branches[len(branches)-1]
+			continue
+		case OpEndIf:
+			if len(branches) == 0 {
+				return errors.New("OP_ENDIF without OP_IF")
+			}
+			branches = branches[:len(branches)-1]
+			continue
+		}
+		if !running() {
+			continue
+		}
+
+		err := vm.step(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(branches) > 0 {
+		return errors.New("OP_IF without OP_ENDIF")
+	}
+
+	return nil
+}
+
+// step runs an opcode other than the conditionals.
+func (vm *scriptVM) step(op scriptOp) error {
+	if op.isPush() {
+		return vm.push(op.data)
+	}
+
+	switch op.code {
+	case OpTrue:
+		return vm.push([]byte{1})
+	case OpVerify:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if !asBool(top) {
+			return errors.New("OP_VERIFY failed")
+		}
+	case OpReturn:
+		return errors.New("OP_RETURN")
+	case OpDrop:
+		_, err := vm.pop()
+		return err
+	case OpDup:
+		if len(vm.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		return vm.push(vm.stack[len(vm.stack)-1])
+	case OpEqual, OpEqualVerify:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if op.code == OpEqualVerify {
+			if !bytes.Equal(a, b) {
+				return errors.New("OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		return vm.push(fromBool(bytes.Equal(a, b)))
+	case OpSha256:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		return vm.push(hash[:])
+	case OpHash160:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.push(HashPubKey(top))
+	case OpCheckSig, OpCheckSigVerify:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		valid := vm.checkSig != nil && vm.checkSig(signature, pubKey)
+		if op.code == OpCheckSigVerify {
+			if !valid {
+				return errors.New("OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		return vm.push(fromBool(valid))
+	default:
+		return fmt.Errorf("unknown opcode 0x%02x", op.code)
+	}
+
+	return nil
+}
+
+// asBool is how the stack holds booleans: anything but zero bytes is true.
+func asBool(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fromBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptConditionals(t *testing.T) {
+	// Pays 1 unless the top of the stack is false, then 2.
+	locking := Script{}.AddOp(OpIf).AddData([]byte{1}).AddOp(OpElse).AddData([]byte{2}).AddOp(OpEndIf).
+		AddData([]byte{2}).AddOp(OpEqual)
+	assert.Equal(t, "OP_IF 01 OP_ELSE 02 OP_ENDIF 02 OP_EQUAL", locking.String())
+
+	assert.NoError(t, VerifyScript(Script{}.AddOp(OpFalse), locking, nil))
+	assert.Error(t, VerifyScript(Script{}.AddData([]byte{1}), locking, nil))
+	assert.Error(t, VerifyScript(Script{}, locking, nil), "OP_IF needs a condition")
+
+	nested := Script{}.AddOp(OpNotIf).AddOp(OpIf).AddOp(OpReturn).AddOp(OpEndIf).AddOp(OpEndIf).AddOp(OpTrue)
+	assert.NoError(t, VerifyScript(Script{}.AddData([]byte{1}), nested, nil), "Branches not taken are skipped")
+	assert.Error(t, VerifyScript(Script{}.AddData([]byte{1}).AddOp(OpFalse), nested, nil))
+
+	assert.Error(t, VerifyScript(Script{}.AddOp(OpTrue), Script{}.AddOp(OpIf), nil))
+	assert.Error(t, VerifyScript(Script{}.AddOp(OpTrue), Script{}.AddOp(OpEndIf), nil))
+	assert.Error(t, VerifyScript(Script{}.AddOp(OpTrue), Script{}.AddOp(OpElse), nil))
+}
+
+func TestScriptHashLock(t *testing.T) {
+	secret := []byte("open sesame")
+	hash := sha256.Sum256(secret)
+	locking := Script{}.AddOp(OpSha256).AddData(hash[:]).AddOp(OpEqual)
+
+	assert.NoError(t, VerifyScript(Script{}.AddData(secret), locking, nil))
+	assert.Error(t, VerifyScript(Script{}.AddData([]byte("open barley")), locking, nil))
+	assert.Error(t, VerifyScript(Script{}.AddData(secret).AddOp(OpDrop).AddData(secret), locking, nil),
+		"Unlocking scripts may only push data")
+
+	long := make([]byte, 200)
+	assert.NoError(t, VerifyScript(Script{}.AddData(long), Script{}.AddOp(OpDrop).AddOp(OpTrue), nil))
+	assert.Error(t, VerifyScript(Script{OpPushData1, 10, 1}, Script{}.AddOp(OpTrue), nil), "Truncated push")
+	assert.Error(t, VerifyScript(Script{}, Script{0xff}, nil), "Unknown opcode")
+}
+
+func TestP2PKHScript(t *testing.T) {
+	w := NewWallet()
+	pubKeyHash := HashPubKey(w.PublicKey)
+	locking := P2PKHScript(pubKeyHash)
+
+	got, ok := locking.PubKeyHash()
+	assert.True(t, ok)
+	assert.Equal(t, pubKeyHash, got)
+	_, ok = Script{}.AddOp(OpTrue).PubKeyHash()
+	assert.False(t, ok)
+
+	hash := sha256.Sum256([]byte("spending transaction"))
+	signature := signHash(w.PrivateKey, hash[:])
+	checkSig := func(sig, pubKey []byte) bool {
+		return verifySignature(hash[:], sig, pubKey)
+	}
+
+	unlocking := P2PKHUnlockingScript(signature, w.PublicKey)
+	assert.NoError(t, VerifyScript(unlocking, locking, checkSig))
+	pubKey, ok := unlocking.P2PKHPubKey()
+	assert.True(t, ok)
+	assert.Equal(t, w.PublicKey, pubKey)
+
+	other := NewWallet()
+	assert.Error(t, VerifyScript(P2PKHUnlockingScript(signHash(other.PrivateKey, hash[:]), other.PublicKey), locking, checkSig),
+		"Key does not hash to the locking hash")
+	assert.Error(t, VerifyScript(P2PKHUnlockingScript(signHash(w.PrivateKey, []byte("something else")), w.PublicKey), locking, checkSig),
+		"Signature is for another transaction")
+}
+
+func TestSpendNonStandardOutput(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+	miner := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	u := UTXOSet{bc}
+
+	// Alice locks 4 coins with a hash only she knows the preimage of.
+	secret := []byte("preimage")
+	hash := sha256.Sum256(secret)
+	lock := NewUTXOTransaction(alice, string(bob.GetAddress()), 1, 0, &u)
+	lock.Vout[0] = TXOutput{4, Script{}.AddOp(OpSha256).AddData(hash[:]).AddOp(OpEqual)}
+	lock.Vout[1].Value -= 3
+	lock.ID = lock.UnsignedHash()
+	signTestTransaction(u, lock, alice.PrivateKey)
+
+	block := mineTestBlock(bc, bc.mustGetBlock(bc.tip), miner, lock)
+	_, _, err := bc.AddBlock(block)
+	assert.NoError(t, err)
+	acc, _ := u.FindCoins(HashPubKey(bob.PublicKey), 1, nil)
+	assert.Equal(t, 0, acc, "Hash locked output belongs to no wallet")
+
+	claim := &Transaction{nil, []TXInput{{lock.ID, 0, nil, 0}}, []TXOutput{*NewTXOutput(4, string(bob.GetAddress()))}}
+	claim.ID = claim.Hash()
+	claim.Vin[0].ScriptSig = Script{}.AddData([]byte("guess"))
+	_, _, err = bc.AddBlock(mineTestBlock(bc, block, miner, claim))
+	assertRejected(t, RejectBadSignature, err)
+
+	claim.Vin[0].ScriptSig = Script{}.AddData(secret)
+	_, _, err = bc.AddBlock(mineTestBlock(bc, block, miner, claim))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, testBalance(u, bob))
+}
+
+func TestWalletWithUnpaddedKeyCanSpend(t *testing.T) {
+	// Wallets created before keys were padded have a shorter key when a
+	// coordinate starts with a zero byte.
+	var old *Wallet
+	for old == nil {
+		w := NewWallet()
+		if key := encodeLegacyPubKey(&w.PrivateKey.PublicKey); len(key) < 64 {
+			old = &Wallet{w.PrivateKey, key}
+		}
+	}
+	bob := NewWallet()
+	miner := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, string(old.GetAddress()))
+	u := UTXOSet{bc}
+
+	pay := NewUTXOTransaction(old, string(bob.GetAddress()), 3, 0, &u)
+	_, _, err := bc.AddBlock(mineTestBlock(bc, bc.mustGetBlock(bc.tip), miner, pay))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, testBalance(u, bob))
+}
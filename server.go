@@ -3,380 +3,1158 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const protocol = "tcp"
-const nodeVersion = 1
+const nodeVersion = 2
 const commandLength = 12
 
-var nodeAddress string
-var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}
-var mempool = make(map[string]Transaction)
+var keepaliveTick = time.Second
+
+// maxGetAddrReply caps the addresses sent in reply to one getaddr, and
+// addrGossipSize those sent unasked every addrGossipInterval.
+const maxGetAddrReply = 250
+const addrGossipSize = 10
+
+var connectInterval = 5 * time.Second
+var addrGossipInterval = 10 * time.Minute
+
+// maxInvPerMsg caps the block hashes sent in reply to one getblocks.
+var maxInvPerMsg = 500
+
+// Node is a running network node: the chain it serves together with the
+// peers, mempool and sync state around it. It is safe for concurrent use
+// by its peer goroutines and miner.
+type Node struct {
+	cfg     Config
+	address string
+	nonce   uint64
+	bc      *Blockchain
+	orphans *OrphanPool
+	peers   *PeerManager
+	sync    *HeaderSync
+	bans    *BanList
+	addrs   *AddrManager
+	mempool *Mempool
+	miner   *Miner
+
+	// chainMu serializes changes to the chain. Readers of the tip hold it
+	// for reading.
+	chainMu sync.RWMutex
+
+	// mu guards the fields below.
+	mu      sync.Mutex
+	dialing map[string]bool
+
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
 
 type addr struct {
 	AddrList []string
 }
 
+type banlist struct {
+	Bans map[string]time.Time
+}
+
 type block struct {
-	AddrFrom string
-	Block    []byte
+	Block []byte
 }
 
+type getaddr struct{}
+
 type getblocks struct {
-	AddrFrom string
+	Locator [][]byte
+	Stop    []byte
 }
 
 type getdata struct {
-	AddrFrom string
-	Type     string
-	ID       []byte
+	Type string
+	ID   []byte
 }
 
 type inv struct {
-	AddrFrom string
-	Type     string
-	Items    [][]byte
+	Type  string
+	Items [][]byte
+}
+
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
+}
+
+type mempool struct {
+	Transactions [][]byte
+}
+
+type peerinfo struct {
+	Peers []PeerInfo
+}
+
+// setban bans IP until Until, lifts its ban if Until is zero, or lifts
+// every ban if IP is empty.
+type setban struct {
+	IP    string
+	Until time.Time
 }
 
 type tx struct {
-	AddFrom     string
 	Transaction []byte
 }
 
+func (s setban) apply(bl *BanList) {
+	switch {
+	case s.IP == "":
+		bl.Clear()
+	case s.Until.IsZero():
+		bl.Unban(s.IP)
+	default:
+		bl.Ban(s.IP, s.Until)
+	}
+}
+
 type version struct {
-	Statement  int
+	Version    int
+	Services   uint64
 	BestHeight int
 	AddrFrom   string
+	Nonce      uint64
 }
 
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	miningAddress = minerAddress
-	ln, _ := net.Listen(protocol, nodeAddress)
-	defer ln.Close()
+// NewNode returns a node for bc that runs as set out in cfg.
+func NewNode(cfg Config, bc *Blockchain) *Node {
+	return &Node{
+		cfg:     cfg,
+		address: cfg.advertised(),
+		nonce:   rand.Uint64(),
+		bc:      bc,
+		orphans: NewOrphanPool(),
+		peers:   NewPeerManager(),
+		sync:    NewHeaderSync(bc),
+		bans:    NewBanList(),
+		addrs:   NewAddrManager(),
+		mempool: NewMempool(cfg.MaxMempoolSize, cfg.MempoolExpiry),
+		dialing: make(map[string]bool),
+		quit:    make(chan struct{}),
+	}
+}
 
+// StartServer runs node nodeID until it is interrupted. Its pending
+// transactions are kept across runs.
+func StartServer(nodeID string, cfg Config, minerAddress string, minTxs int, mineEmpty bool) {
 	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+	n := NewNode(cfg, bc)
+
+	bans, err := LoadBanList(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	n.bans = bans
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	n.addrs, err = LoadAddrManager(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, seed := range cfg.Seeds {
+		if seed != n.address {
+			n.addrs.Add([]string{seed}, time.Now())
+		}
+	}
+
+	file := fmt.Sprintf(mempoolFile, nodeID)
+	loaded, err := n.mempool.Load(file, UTXOSet{bc}, time.Now())
+	if err != nil {
+		fmt.Printf("Loading pending transactions failed, starting with none: %s\n", err)
+	}
+	if loaded > 0 {
+		fmt.Printf("Loaded %d pending transactions\n", loaded)
 	}
 
+	if len(minerAddress) > 0 {
+		n.miner = NewMiner(n, minerAddress, minTxs, mineEmpty)
+		n.miner.Start()
+	}
+
+	err = n.Listen()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	served := make(chan struct{})
+	go func() {
+		n.Serve()
+		close(served)
+	}()
+
+	select {
+	case <-interrupt:
+		fmt.Println("Shutting down")
+	case <-served:
+	}
+	n.Stop()
+
+	err = n.mempool.Dump(file)
+	if err != nil {
+		fmt.Printf("Saving pending transactions failed: %s\n", err)
+		return
+	}
+	fmt.Printf("Saved %d pending transactions\n", n.mempool.Count())
+}
+
+// Listen opens the node's listening socket. A zero port picks a free one,
+// and unless told otherwise the node then advertises the address it
+// actually got.
+func (n *Node) Listen() error {
+	ln, err := net.Listen(protocol, n.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	_, port, _ := net.SplitHostPort(n.cfg.Listen)
+	if port == "0" && n.cfg.Advertise == "" {
+		n.address = ln.Addr().String()
+	}
+	n.listener = ln
+
+	return nil
+}
+
+// Serve accepts inbound peers until the node is stopped.
+func (n *Node) Serve() {
+	n.spawn(n.syncLoop)
+	n.spawn(n.keepaliveLoop)
+	n.spawn(n.addrLoop)
+	n.spawn(n.mempoolLoop)
+
 	for {
-		conn, _ := ln.Accept()
-		go handleConnection(conn, bc)
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		// Connections from this machine may be the command line, which
+		// is let in whatever the bans say. Which they are is known after
+		// the handshake.
+		ip := net.ParseIP(remoteIP(conn))
+		if (ip == nil || !ip.IsLoopback()) && n.bans.IsBanned(remoteIP(conn), time.Now()) {
+			conn.Close()
+			continue
+		}
+
+		n.spawn(func() {
+			n.acceptPeer(conn)
+		})
 	}
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
+// spawn runs f in a goroutine that Stop waits for.
+func (n *Node) spawn(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+// Stop stops the miner, closes the listener and every peer, waits for
+// their goroutines to finish and saves the addresses learned.
+func (n *Node) Stop() {
+	if n.miner != nil {
+		n.miner.Stop()
+	}
+	close(n.quit)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for _, p := range n.peers.Peers() {
+		p.Close()
+	}
+	n.wg.Wait()
+	n.addrs.Save()
+}
+
+// Connect dials addr and runs the session in the background. How it went
+// is recorded in the address manager.
+func (n *Node) Connect(addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil && n.bans.IsBanned(host, time.Now()) {
+		return
+	}
+
+	// An address stays in dialing until its peer is added, so that it is
+	// never dialled twice at once.
+	n.mu.Lock()
+	busy := n.dialing[addr] || n.peers.Get(addr) != nil
+	if !busy {
+		n.dialing[addr] = true
+	}
+	n.mu.Unlock()
+	if busy {
+		return
+	}
+	defer func() {
+		n.mu.Lock()
+		delete(n.dialing, addr)
+		n.mu.Unlock()
+	}()
+
+	n.addrs.Attempt(addr, time.Now())
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("%s is not available\n", addr)
+		n.addrs.Failed(addr, time.Now())
+		return
+	}
+	if n.bans.IsBanned(remoteIP(conn), time.Now()) {
+		conn.Close()
+		return
+	}
+
+	p := newPeer(conn, addr, false)
+	err = p.handshake(n.localVersion())
+	if err != nil {
+		fmt.Printf("Handshake with %s failed: %s\n", addr, err)
+		if err == errSelfConnection {
+			n.addrs.Remove(addr)
+		} else {
+			n.addrs.Failed(addr, time.Now())
+		}
+		conn.Close()
+		return
 	}
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("Received %s command\n", command)
+	n.addrs.Good(addr, time.Now())
 
-	switch command {
+	if n.addPeer(p) {
+		n.spawn(func() {
+			n.runPeer(p)
+		})
+	}
+}
+
+// acceptPeer runs the session for an inbound connection.
+func (n *Node) acceptPeer(conn net.Conn) {
+	p := newPeer(conn, conn.RemoteAddr().String(), true)
+	err := p.handshake(n.localVersion())
+	if err != nil {
+		fmt.Printf("Handshake with %s failed: %s\n", p, err)
+		conn.Close()
+		return
+	}
+
+	if n.peers.InboundCount() >= n.cfg.MaxInbound {
+		fmt.Printf("Too many inbound peers, dropping %s\n", p)
+		conn.Close()
+		return
+	}
+
+	if n.addPeer(p) {
+		n.runPeer(p)
+	}
+}
+
+// addPeer registers a peer that completed the handshake, unless it is
+// banned or already connected. Command line sessions are never refused,
+// so that a ban on this machine can be lifted again. Peers that listen
+// are remembered; an inbound one only once it is registered, so that we
+// do not dial it meanwhile.
+func (n *Node) addPeer(p *Peer) bool {
+	if !p.cli() && n.bans.IsBanned(p.ip(), time.Now()) {
+		fmt.Printf("Refusing banned peer %s\n", p)
+		p.Close()
+		return false
+	}
+	if !n.peers.Add(p) {
+		fmt.Printf("Already connected to %s\n", p)
+		p.Close()
+		return false
+	}
+	if listen := p.listenAddr(); listen != "" && listen != n.address {
+		n.addrs.Add([]string{listen}, time.Now())
+	}
+
+	return true
+}
+
+// runPeer runs the session of a registered peer until it ends.
+func (n *Node) runPeer(p *Peer) {
+	defer func() {
+		n.peers.Remove(p)
+		n.sync.DropPeer(p)
+		if listen := p.listenAddr(); listen != "" {
+			n.addrs.Seen(listen, time.Now())
+		}
+		n.fetchBlocks()
+	}()
+
+	// A handshake that was under way when the node stopped ends in a
+	// session that Stop does not know to close.
+	go func() {
+		select {
+		case <-n.quit:
+			p.Close()
+		case <-p.Done():
+		}
+	}()
+
+	fmt.Printf("Connected to %s (height %d), %d peers\n", p, p.version.BestHeight, n.peers.Count())
+	if !p.inbound {
+		p.Send("getaddr", gobEncode(getaddr{}))
+	}
+	if p.version.BestHeight > n.bestHeight() {
+		n.sendGetHeaders(p)
+	}
+
+	err := p.run(n.handleMessage)
+	if isFrameError(err) {
+		n.misbehaving(p, scoreBadFrame, err.Error())
+	}
+	fmt.Printf("Disconnected from %s\n", p)
+}
+
+func (n *Node) handleMessage(p *Peer, msg *message) {
+	fmt.Printf("Received %s command from %s\n", msg.Command, p)
+
+	defer func() {
+		if r := recover(); r != nil {
+			n.misbehaving(p, scoreHandlerPanic, fmt.Sprintf("%s message crashed its handler: %v", msg.Command, r))
+		}
+	}()
+
+	switch msg.Command {
 	case "addr":
-		handleAddr(request)
+		n.handleAddr(p, msg.Payload)
 	case "block":
-		handleBlock(request, bc)
+		n.handleBlock(p, msg.Payload)
+	case "getaddr":
+		n.handleGetAddr(p)
 	case "inv":
-		handleInv(request, bc)
+		n.handleInv(p, msg.Payload)
 	case "getblocks":
-		handleGetBlocks(request, bc)
+		n.handleGetBlocks(p, msg.Payload)
 	case "getdata":
-		handleGetData(request, bc)
+		n.handleGetData(p, msg.Payload)
+	case "getheaders":
+		n.handleGetHeaders(p, msg.Payload)
+	case "getmempool":
+		n.handleGetMempool(p)
+	case "getpeerinfo":
+		n.handleGetPeerInfo(p)
+	case "headers":
+		n.handleHeaders(p, msg.Payload)
+	case "ping":
+		n.handlePing(p, msg.Payload)
+	case "setban":
+		n.handleSetBan(p, msg.Payload)
+	case "pong":
+		n.handlePong(p, msg.Payload)
 	case "tx":
-		handleTx(request, bc)
-	case "version":
-		handleVersion(request, bc)
+		n.handleTx(p, msg.Payload)
 	default:
 		fmt.Println("Unknown command!")
 	}
-
-	conn.Close()
 }
 
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
+func (n *Node) handleAddr(p *Peer, request []byte) {
 	var payload addr
+	if !n.decode(p, request, &payload) {
+		return
+	}
+
+	if len(payload.AddrList) > maxAddrPerMsg {
+		n.misbehaving(p, scoreMalformedMessage, fmt.Sprintf("%d addresses in one message", len(payload.AddrList)))
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
+	var addrs []string
+	for _, node := range payload.AddrList {
+		if node != n.address {
+			addrs = append(addrs, node)
+		}
+	}
+	added := n.addrs.Add(addrs, time.Now())
+	fmt.Printf("Learned %d new addresses, %d known now\n", added, n.addrs.Count())
+}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
+// handleGetAddr answers with a random sample of the good addresses this
+// node knows.
+func (n *Node) handleGetAddr(p *Peer) {
+	addrs := n.addrs.Sample(maxGetAddrReply, time.Now())
+	p.Send("addr", gobEncode(addr{addrs}))
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func (n *Node) handleBlock(p *Peer, request []byte) {
 	var payload block
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
-
-	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	block := &Block{}
+	if !n.decode(p, payload.Block, block) {
+		return
+	}
 
 	fmt.Println("Recevied a new block!")
-	bc.AddBlock(block)
+	synced := n.sync.Received(block.Hash)
+	err := n.processBlock(block, p)
+	if verr, ok := err.(*ValidationError); ok && verr.Reason == RejectOrphan && len(block.PrevBlockHash) > 0 {
+		n.orphans.Add(block, p)
+
+		// Blocks downloaded in parallel arrive out of order, and their
+		// parents are already on the way.
+		if !synced {
+			missing := n.orphans.MissingAncestor(block.PrevBlockHash)
+			fmt.Printf("Block %x is an orphan, requesting %x\n", block.Hash, missing)
+			sendGetData(p, "block", missing)
+		}
+	} else if err != nil {
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		if synced {
+			n.sync.Invalidate(block.Hash)
+		}
+		// A block from the future may become valid later on.
+		if verr, ok := err.(*ValidationError); ok && verr.Reason != RejectTimeTooNew {
+			n.misbehaving(p, scoreInvalidBlock, err.Error())
+		}
+	}
+
+	n.fetchBlocks()
+}
+
+// processBlock adds block to the chain followed by any orphans that were
+// waiting for it, and keeps the mempool in line with the active chain.
+// Every block that becomes part of the active chain is announced to all
+// peers but from, the one that sent block.
+func (n *Node) processBlock(block *Block, from *Peer) error {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
 
+	connected, disconnected, err := n.bc.AddBlock(block)
+	if err != nil {
+		return err
+	}
+	n.mempool.Update(UTXOSet{n.bc}, connected, disconnected, time.Now())
 	fmt.Printf("Added block %x\n", block.Hash)
+	announce := connected
+
+	parents := [][]byte{block.Hash}
+	for len(parents) > 0 {
+		children := n.orphans.TakeChildren(parents[0])
+		parents = parents[1:]
+
+		for _, orphan := range children {
+			child := orphan.block
+			connected, disconnected, err := n.bc.AddBlock(child)
+			if err != nil {
+				fmt.Printf("Rejected orphan block %x: %s\n", child.Hash, err)
+				if verr, ok := err.(*ValidationError); ok && verr.Reason != RejectTimeTooNew && orphan.from != nil {
+					n.misbehaving(orphan.from, scoreInvalidBlock, err.Error())
+				}
+				continue
+			}
+			n.mempool.Update(UTXOSet{n.bc}, connected, disconnected, time.Now())
+			fmt.Printf("Added orphan block %x\n", child.Hash)
+			announce = append(announce, connected...)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+			parents = append(parents, child.Hash)
+		}
+	}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+	if len(announce) > 0 {
+		n.announceBlocks(announce, from)
+	}
+	if n.miner != nil {
+		n.miner.Notify()
 	}
+
+	return nil
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+// MempoolTransactions returns a snapshot of the transactions waiting to be
+// mined.
+func (n *Node) MempoolTransactions() []*Transaction {
+	return n.mempool.Transactions()
+}
+
+func (n *Node) handleGetBlocks(p *Peer, request []byte) {
 	var payload getblocks
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
+	n.chainMu.RLock()
+	hashes := n.bc.LocateBlocks(payload.Locator, payload.Stop, maxInvPerMsg)
+	n.chainMu.RUnlock()
+
+	if len(hashes) == 0 {
+		return
+	}
 
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	sendInv(p, "block", hashes)
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func (n *Node) handleGetData(p *Peer, request []byte) {
 	var payload getdata
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
 	if payload.Type == "block" {
-		block, err := bc.GetBlock([]byte(payload.ID))
+		block, err := n.bc.GetBlock([]byte(payload.ID))
 		if err != nil {
 			return
 		}
 
-		sendBlock(payload.AddrFrom, &block)
+		sendBlock(p, &block)
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := n.mempool.Get(payload.ID)
+		if !ok {
+			return
+		}
 
-		sendTx(payload.AddrFrom, &tx)
-		// delete(mempool, txID)
+		sendTx(p, tx)
 	}
 }
 
-func handleInv(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func (n *Node) handleInv(p *Peer, request []byte) {
 	var payload inv
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		// Announced blocks are fetched through their headers, which
+		// also brings in any ancestors that are missing.
+		for _, hash := range payload.Items {
+			if !n.bc.HasBlock(hash) && !n.sync.Has(hash) {
+				n.sendGetHeaders(p)
+				break
 			}
 		}
-		blocksInTransit = newInTransit
+
+		// A full reply to getblocks means there are more blocks after
+		// the last one listed.
+		if len(payload.Items) == maxInvPerMsg {
+			n.sendGetBlocks(p, payload.Items[len(payload.Items)-1])
+		}
 	}
 
-	if payload.Type == "tx" {
+	if payload.Type == "tx" && len(payload.Items) > 0 {
 		txID := payload.Items[0]
 
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		if !n.mempool.Has(txID) {
+			sendGetData(p, "tx", txID)
 		}
 	}
 }
 
-func handleTx(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func (n *Node) handleTx(p *Peer, request []byte) {
 	var payload tx
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
+	var tx Transaction
+	if !n.decode(p, payload.Transaction, &tx) {
+		return
+	}
 
-	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	// Every node relays what it accepts, so a transaction may come back
+	// from another peer.
+	if n.mempool.Has(tx.ID) {
+		return
+	}
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
+	n.chainMu.RLock()
+	err := n.mempool.Add(&tx, UTXOSet{n.bc}, time.Now())
+	n.chainMu.RUnlock()
+	if err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		if !honestTxReject(err) {
+			n.misbehaving(p, scoreInvalidTx, err.Error())
 		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
+		return
+	}
 
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+	n.peers.Broadcast("inv", gobEncode(inv{"tx", [][]byte{tx.ID}}), p)
+	if n.miner != nil {
+		n.miner.Notify()
+	}
+}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
+func (n *Node) handleGetHeaders(p *Peer, request []byte) {
+	var payload getheaders
+	if !n.decode(p, request, &payload) {
+		return
+	}
+
+	var hdrs []BlockHeader
+	n.chainMu.RLock()
+	for _, hash := range n.bc.LocateBlocks(payload.Locator, payload.Stop, maxHeadersPerMsg) {
+		hdrs = append(hdrs, n.bc.mustGetBlock(hash).Header())
+	}
+	n.chainMu.RUnlock()
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+	p.Send("headers", gobEncode(headers{hdrs}))
+}
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+func (n *Node) handleHeaders(p *Peer, request []byte) {
+	var payload headers
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
-			fmt.Println("New block is mined!")
+	fmt.Printf("Received %d headers\n", len(payload.Headers))
+	err := n.sync.AddHeaders(p, payload.Headers)
+	if err == errTooManyHeaders {
+		// The rest is asked for again once the blocks have caught up.
+		fmt.Printf("Holding off headers from %s: %s\n", p, err)
+		n.fetchBlocks()
+		return
+	}
+	if err != nil {
+		fmt.Printf("Rejected headers from %s: %s\n", p, err)
+		if verr, ok := err.(*ValidationError); ok && verr.Reason == RejectOrphan {
+			n.misbehaving(p, scoreUnconnectedHeaders, err.Error())
+		} else {
+			n.misbehaving(p, scoreInvalidHeaders, err.Error())
+		}
+		return
+	}
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+	// A full message means the peer has more to send.
+	if len(payload.Headers) == maxHeadersPerMsg {
+		n.sendGetHeaders(p)
+	}
+	n.fetchBlocks()
+}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+func (n *Node) handlePing(p *Peer, request []byte) {
+	var payload ping
+	if !n.decode(p, request, &payload) {
+		return
+	}
+
+	p.Send("pong", gobEncode(pong{payload.Nonce}))
+}
+
+func (n *Node) handlePong(p *Peer, request []byte) {
+	var payload pong
+	if !n.decode(p, request, &payload) {
+		return
+	}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
+	if !p.pongReceived(payload.Nonce, time.Now()) {
+		fmt.Printf("Unexpected pong from %s\n", p)
+	}
+}
+
+// handleSetBan changes the ban list on behalf of the CLI. Only command
+// line sessions may do that, not even other nodes on this machine.
+func (n *Node) handleSetBan(p *Peer, request []byte) {
+	if !p.cli() {
+		n.misbehaving(p, scoreMalformedMessage, "setban from a peer node")
+		return
+	}
+
+	var payload setban
+	if !n.decode(p, request, &payload) {
+		return
+	}
+
+	payload.apply(n.bans)
+	if !payload.Until.IsZero() {
+		for _, peer := range n.peers.Peers() {
+			if peer.ip() == payload.IP && !peer.cli() {
+				peer.Close()
 			}
 		}
 	}
+
+	bans := make(map[string]time.Time)
+	now := time.Now()
+	for _, ip := range n.bans.Active(now) {
+		bans[ip] = n.bans.Until(ip)
+	}
+	p.Send("banlist", gobEncode(banlist{bans}))
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload version
+// handleGetPeerInfo tells the CLI about our peers. Other nodes have no
+// business learning the addresses and latencies of our peers, so only
+// command line sessions are answered.
+func (n *Node) handleGetPeerInfo(p *Peer) {
+	if !p.cli() {
+		fmt.Printf("Ignoring getpeerinfo from peer node %s\n", p)
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	dec.Decode(&payload)
+	var infos []PeerInfo
+	for _, peer := range n.peers.Peers() {
+		infos = append(infos, peer.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	p.Send("peerinfo", gobEncode(peerinfo{infos}))
+}
 
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+func (n *Node) handleGetMempool(p *Peer) {
+	var txs [][]byte
+	for _, tx := range n.mempool.Transactions() {
+		txs = append(txs, tx.Serialize())
 	}
 
-	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	p.Send("mempool", gobEncode(mempool{txs}))
+}
+
+// keepaliveLoop pings every peer now and then and evicts peers that stop
+// answering.
+func (n *Node) keepaliveLoop() {
+	ticker := time.NewTicker(keepaliveTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.keepalive(time.Now())
+		case <-n.quit:
+			return
+		}
 	}
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
+func (n *Node) keepalive(now time.Time) {
+	for _, p := range n.peers.Peers() {
+		if p.pingTimedOut(now) {
+			fmt.Printf("Evicting %s, it stopped answering pings\n", p)
+			if !p.inbound {
+				n.addrs.Failed(p.addr, now)
+			}
+			p.Close()
+			continue
+		}
 
-	sendData(address, request)
+		if nonce, ok := p.nextPing(now); ok {
+			p.Send("ping", gobEncode(ping{nonce}))
+		}
+	}
 }
 
-func sendBlock(addr string, b *Block) {
-	data := block{nodeAddress, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
+// addrLoop keeps the node connected to MaxOutbound peers picked from
+// the address manager, tells peers about good addresses now and then and
+// saves the addresses.
+func (n *Node) addrLoop() {
+	connectTicker := time.NewTicker(connectInterval)
+	defer connectTicker.Stop()
+	gossipTicker := time.NewTicker(addrGossipInterval)
+	defer gossipTicker.Stop()
 
-	sendData(addr, request)
+	n.connectOutbound(time.Now())
+	for {
+		select {
+		case <-connectTicker.C:
+			n.connectOutbound(time.Now())
+			n.addrs.Save()
+		case <-gossipTicker.C:
+			n.gossipAddrs(time.Now())
+		case <-n.quit:
+			return
+		}
+	}
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+// connectOutbound dials addresses until MaxOutbound outbound peers are
+// connected or being dialled.
+func (n *Node) connectOutbound(now time.Time) {
+	exclude := map[string]bool{n.address: true}
+	outbound := 0
+	for _, p := range n.peers.Peers() {
+		exclude[p.addr] = true
+		if !p.inbound {
+			outbound++
+		}
+	}
+
+	n.mu.Lock()
+	for addr := range n.dialing {
+		if !exclude[addr] {
+			exclude[addr] = true
+			outbound++
+		}
+	}
+	n.mu.Unlock()
 
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
+	for ; outbound < n.cfg.MaxOutbound; outbound++ {
+		addr, ok := n.addrs.Select(exclude, now)
+		if !ok {
+			return
+		}
+		exclude[addr] = true
+
+		n.spawn(func() {
+			n.Connect(addr)
+		})
+	}
+}
+
+// gossipAddrs sends every peer a few good addresses along with our own.
+func (n *Node) gossipAddrs(now time.Time) {
+	for _, p := range n.peers.Peers() {
+		addrs := append(n.addrs.Sample(addrGossipSize, now), n.address)
+		p.Send("addr", gobEncode(addr{addrs}))
+	}
+}
+
+// mempoolLoop drops the transactions that have been pending for too long.
+func (n *Node) mempoolLoop() {
+	ticker := time.NewTicker(mempoolExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if expired := n.mempool.Expire(time.Now()); expired > 0 {
+				fmt.Printf("%d transactions expired from the mempool\n", expired)
 			}
+		case <-n.quit:
+			return
 		}
+	}
+}
 
-		knownNodes = updatedNodes
+// fetchBlocks asks peers for the next blocks of the best header chain.
+func (n *Node) fetchBlocks() {
+	for p, hashes := range n.sync.NextRequests(n.peers.Peers()) {
+		for _, hash := range hashes {
+			sendGetData(p, "block", hash)
+		}
+	}
+}
+
+// syncLoop re-requests blocks from other peers when a peer does not
+// deliver them in time, and asks throttled peers for more headers once
+// their blocks have caught up.
+func (n *Node) syncLoop() {
+	ticker := time.NewTicker(syncTickInterval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-ticker.C:
+			for _, p := range n.sync.Expire(time.Now()) {
+				fmt.Printf("Block request to %s timed out\n", p)
+			}
+			for _, p := range n.sync.Resume() {
+				n.sendGetHeaders(p)
+			}
+			n.fetchBlocks()
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+func (n *Node) sendGetHeaders(p *Peer) {
+	n.chainMu.RLock()
+	tip := n.bc.tip
+	work := n.bc.GetChainWork(tip)
+	n.chainMu.RUnlock()
+
+	payload := gobEncode(getheaders{n.sync.Locator(tip, work), nil})
+	p.Send("getheaders", payload)
+}
+
+// decode decodes a message payload into v. A payload that does not decode
+// counts against the peer.
+func (n *Node) decode(p *Peer, payload []byte, v interface{}) bool {
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+	if err != nil {
+		n.misbehaving(p, scoreMalformedMessage, fmt.Sprintf("malformed payload: %s", err))
+		return false
+	}
+
+	return true
+}
+
+// misbehaving adds points to the misbehavior score of p for breaking the
+// protocol. Once the score reaches banThreshold the peer is disconnected
+// and banned. A command line session is only disconnected, since banning
+// it would lock the command line out along with it.
+func (n *Node) misbehaving(p *Peer, points int, reason string) {
+	score := p.addBanScore(points)
+	fmt.Printf("Peer %s misbehaved: %s (score %d)\n", p, reason, score)
+
+	if score < banThreshold {
 		return
 	}
+	if !p.cli() {
+		fmt.Printf("Banning %s for %s\n", p.ip(), defaultBanDuration)
+		n.bans.Ban(p.ip(), time.Now().Add(defaultBanDuration))
+	}
+	p.Close()
+}
+
+// announceBlocks tells every peer but skip about blocks this node has
+// connected, so that they travel further than the peers of their miner.
+func (n *Node) announceBlocks(blocks []*Block, skip *Peer) {
+	var hashes [][]byte
+	for _, b := range blocks {
+		hashes = append(hashes, b.Hash)
+	}
+
+	n.peers.Broadcast("inv", gobEncode(inv{"block", hashes}), skip)
+}
+
+func sendBlock(p *Peer, b *Block) {
+	payload := gobEncode(block{b.Serialize()})
+	p.Send("block", payload)
+}
+
+func sendInv(p *Peer, kind string, items [][]byte) {
+	payload := gobEncode(inv{kind, items})
+	p.Send("inv", payload)
+}
+
+// sendGetBlocks asks p for the blocks after our tip, or after the block
+// hash from when continuing a previous reply.
+func (n *Node) sendGetBlocks(p *Peer, from []byte) {
+	n.chainMu.RLock()
+	locator := n.bc.BlockLocator()
+	n.chainMu.RUnlock()
+
+	if from != nil {
+		locator = append([][]byte{from}, locator...)
+	}
+
+	payload := gobEncode(getblocks{locator, nil})
+	p.Send("getblocks", payload)
+}
+
+func sendGetData(p *Peer, kind string, id []byte) {
+	payload := gobEncode(getdata{kind, id})
+	p.Send("getdata", payload)
+}
+
+func sendTx(p *Peer, tnx *Transaction) {
+	payload := gobEncode(tx{tnx.Serialize()})
+	p.Send("tx", payload)
+}
+
+// submitTx hands tnx to the node at address from a process that does not
+// run a node itself, using a short-lived session.
+func submitTx(address string, bc *Blockchain, tnx *Transaction) error {
+	conn, err := openSession(address, bc.GetBestHeight())
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	io.Copy(conn, bytes.NewReader(data))
+	return writeMessage(conn, "tx", gobEncode(tx{tnx.Serialize()}))
 }
 
-func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
+// queryPeerInfo asks the node at address about its peers.
+func queryPeerInfo(address string) ([]PeerInfo, error) {
+	var payload peerinfo
+	err := queryNode(address, "getpeerinfo", nil, "peerinfo", &payload)
 
-	sendData(address, request)
+	return payload.Peers, err
 }
 
-func sendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
+// queryMempool asks the node at address for its pending transactions,
+// parents before their children.
+func queryMempool(address string) ([]*Transaction, error) {
+	var payload mempool
+	err := queryNode(address, "getmempool", nil, "mempool", &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var txs []*Transaction
+	for _, data := range payload.Transactions {
+		var tx Transaction
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tx)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, &tx)
+	}
 
-	sendData(address, request)
+	return txs, nil
 }
 
-func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
+// setBan has the node at address run a setban request and returns the bans
+// in force afterwards.
+func setBan(address string, request setban) (map[string]time.Time, error) {
+	var payload banlist
+	err := queryNode(address, "setban", gobEncode(request), "banlist", &payload)
 
-	sendData(address, request)
+	return payload.Bans, err
 }
 
-func sendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
+// queryNode sends request with payload to the node at address and decodes
+// the first reply message into v.
+func queryNode(address, request string, payload []byte, reply string, v interface{}) error {
+	conn, err := openSession(address, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	sendData(addr, request)
+	err = writeMessage(conn, request, payload)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		if msg.Command != reply {
+			continue
+		}
+
+		return gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(v)
+	}
 }
 
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(version{nodeVersion, bestHeight, nodeAddress})
+// openSession connects to the node at address on behalf of a process that
+// does not run a node itself.
+func openSession(address string, bestHeight int) (net.Conn, error) {
+	conn, err := net.DialTimeout(protocol, address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-	request := append(commandToBytes("version"), payload...)
+	p := newPeer(conn, address, false)
+	err = p.handshake(version{nodeVersion, nodeServices, bestHeight, "", rand.Uint64()})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	sendData(addr, request)
+	return conn, nil
 }
 
 func commandToBytes(command string) []byte {
@@ -405,10 +1183,16 @@ func extractCommand(request []byte) []byte {
 	return request[:commandLength]
 }
 
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
-	}
+// localVersion is the version message this node opens every session with.
+func (n *Node) localVersion() version {
+	return version{nodeVersion, nodeServices, n.bestHeight(), n.address, n.nonce}
+}
+
+func (n *Node) bestHeight() int {
+	n.chainMu.RLock()
+	defer n.chainMu.RUnlock()
+
+	return n.bc.GetBestHeight()
 }
 
 func gobEncode(data interface{}) []byte {
@@ -420,12 +1204,7 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
+// KnownNodes returns the addresses this node knows about.
+func (n *Node) KnownNodes() []string {
+	return n.addrs.Addresses()
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testConfig has a node listen on a free loopback port without seeds.
+func testConfig() Config {
+	return Config{Listen: "127.0.0.1:0", MaxInbound: defaultMaxInbound, MaxOutbound: defaultMaxOutbound}
+}
+
+// startTestNode runs a node for bc with testConfig.
+func startTestNode(t *testing.T, bc *Blockchain) *Node {
+	return runTestNode(t, NewNode(testConfig(), bc))
+}
+
+func runTestNode(t *testing.T, n *Node) *Node {
+	if err := n.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go n.Serve()
+	t.Cleanup(n.Stop)
+
+	return n
+}
+
+func waitForHeight(t *testing.T, height int, nodes ...*Node) {
+	deadline := time.Now().Add(10 * time.Second)
+	for _, n := range nodes {
+		for n.bestHeight() < height {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is stuck at height %d, want %d", n.address, n.bestHeight(), height)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestNodesSyncAndRelayBlocks(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bcA := newTestBlockchain(t, address)
+	genesis := bcA.mustGetBlock(bcA.tip)
+
+	a := startTestNode(t, bcA)
+	b := startTestNode(t, newTestChainFrom(t, genesis))
+	c := startTestNode(t, newTestChainFrom(t, genesis))
+
+	prev := genesis
+	for i := 0; i < 3; i++ {
+		block := mineTestBlock(bcA, prev, address)
+		assert.NoError(t, a.processBlock(block, nil))
+		prev = block
+	}
+
+	b.Connect(a.address)
+	c.Connect(a.address)
+	waitForHeight(t, 3, b, c)
+
+	c.Connect(b.address)
+	assert.Equal(t, 2, a.peers.Count())
+	assert.Contains(t, a.KnownNodes(), b.address, "Inbound peers are known by their listening address")
+
+	block := mineTestBlock(bcA, prev, address)
+	assert.NoError(t, a.processBlock(block, nil))
+	waitForHeight(t, 4, b, c)
+
+	b.chainMu.RLock()
+	assert.Equal(t, block.Hash, b.bc.tip)
+	b.chainMu.RUnlock()
+	c.chainMu.RLock()
+	assert.Equal(t, block.Hash, c.bc.tip)
+	c.chainMu.RUnlock()
+}
+
+func TestBlocksAreRelayedAlongALine(t *testing.T) {
+	interval := connectInterval
+	connectInterval = time.Hour
+	t.Cleanup(func() { connectInterval = interval })
+
+	address := string(NewWallet().GetAddress())
+	bcA := newTestBlockchain(t, address)
+	genesis := bcA.mustGetBlock(bcA.tip)
+
+	a := startTestNode(t, bcA)
+	b := startTestNode(t, newTestChainFrom(t, genesis))
+	c := startTestNode(t, newTestChainFrom(t, genesis))
+	b.Connect(a.address)
+	c.Connect(b.address)
+
+	prev := genesis
+	for i := 1; i <= 3; i++ {
+		block := mineTestBlock(bcA, prev, address)
+		assert.NoError(t, a.processBlock(block, nil))
+		waitForHeight(t, i, b, c)
+		prev = block
+	}
+
+	assert.Nil(t, c.peers.Get(a.address), "C only hears of the blocks through B")
+	c.chainMu.RLock()
+	assert.Equal(t, prev.Hash, c.bc.tip)
+	c.chainMu.RUnlock()
+}
+
+func TestStopClosesPeersThatFinishTheirHandshakeLate(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	n := NewNode(testConfig(), bc)
+	if err := n.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go n.Serve()
+
+	conn, err := net.Dial(protocol, n.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = readMessage(conn)
+	assert.NoError(t, err, "The node has started its handshake")
+
+	stopped := make(chan struct{})
+	go func() {
+		n.Stop()
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	writeMessage(conn, "version", gobEncode(version{nodeVersion, nodeServices, 0, "127.0.0.1:3001", 1}))
+	writeMessage(conn, "verack", nil)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waits for a peer that connected while it was stopping")
+	}
+}
+
+// nextMessage pops the next message queued for p.
+func nextMessage(t *testing.T, p *Peer) *message {
+	select {
+	case msg := <-p.outbound:
+		return msg
+	default:
+		t.Fatal("no message was queued")
+		return nil
+	}
+}
+
+func decodeInv(t *testing.T, msg *message) inv {
+	var payload inv
+	assert.Equal(t, "inv", msg.Command)
+	assert.NoError(t, gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&payload))
+
+	return payload
+}
+
+func TestGetBlocksSendsWhatIsMissingInPages(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	chain := []*Block{bc.mustGetBlock(bc.tip)}
+	for i := 0; i < 5; i++ {
+		block := mineTestBlock(bc, chain[i], address)
+		_, _, err := bc.AddBlock(block)
+		assert.NoError(t, err)
+		chain = append(chain, block)
+	}
+
+	maxInv := maxInvPerMsg
+	maxInvPerMsg = 2
+	t.Cleanup(func() { maxInvPerMsg = maxInv })
+
+	n := NewNode(Config{}, bc)
+	requester := newPeer(nil, "requester", false)
+	locator := [][]byte{chain[1].Hash, chain[0].Hash}
+
+	n.handleGetBlocks(requester, gobEncode(getblocks{locator, chain[2].Hash}))
+	assert.Equal(t, [][]byte{chain[2].Hash}, decodeInv(t, nextMessage(t, requester)).Items, "Reply ends at the stop hash")
+
+	n.handleGetBlocks(requester, gobEncode(getblocks{locator, nil}))
+	reply := nextMessage(t, requester)
+	assert.Equal(t, [][]byte{chain[2].Hash, chain[3].Hash}, decodeInv(t, reply).Items)
+
+	// A full page makes the requester continue after its last hash.
+	lagging := NewNode(Config{}, newTestChainFrom(t, chain[0]))
+	responder := newPeer(nil, "responder", false)
+	lagging.handleInv(responder, reply.Payload)
+	assert.Equal(t, "getheaders", nextMessage(t, responder).Command)
+	next := nextMessage(t, responder)
+	assert.Equal(t, "getblocks", next.Command)
+
+	n.handleGetBlocks(requester, next.Payload)
+	assert.Equal(t, [][]byte{chain[4].Hash, chain[5].Hash}, decodeInv(t, nextMessage(t, requester)).Items)
+}
+
+func TestPingsMeasureLatency(t *testing.T) {
+	tick := keepaliveTick
+	keepaliveTick = 10 * time.Millisecond
+	t.Cleanup(func() { keepaliveTick = tick })
+
+	address := string(NewWallet().GetAddress())
+	bcA := newTestBlockchain(t, address)
+	a := startTestNode(t, bcA)
+	b := startTestNode(t, newTestChainFrom(t, bcA.mustGetBlock(bcA.tip)))
+	b.Connect(a.address)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		infos, err := queryPeerInfo(a.address)
+		assert.NoError(t, err)
+
+		var latency time.Duration
+		for _, info := range infos {
+			if info.ListenAddr == b.address {
+				assert.True(t, info.Inbound)
+				latency = info.Latency
+			}
+		}
+		if latency > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No round trip was measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSilentPeerIsEvicted(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	n := NewNode(Config{}, bc)
+	p, _ := testPeerPair(t)
+	n.peers.Add(p)
+	n.addrs.Add([]string{p.addr}, time.Now())
+
+	now := time.Now()
+	n.keepalive(now)
+	assert.Equal(t, "ping", nextMessage(t, p).Command)
+
+	n.keepalive(now.Add(pingTimeout / 2))
+	select {
+	case <-p.Done():
+		t.Fatal("Peer was evicted before its ping timed out")
+	default:
+	}
+
+	n.keepalive(now.Add(pingTimeout + time.Second))
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("Silent peer was not evicted")
+	}
+	ka, _ := n.addrs.Get(p.addr)
+	assert.Equal(t, 1, ka.Failures)
+}
+
+func TestNodesLearnAddressesFromPeers(t *testing.T) {
+	defer func(interval time.Duration) { connectInterval = interval }(connectInterval)
+	connectInterval = 50 * time.Millisecond
+
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	genesis := bc.mustGetBlock(bc.tip)
+	a := startTestNode(t, bc)
+	b := startTestNode(t, newTestChainFrom(t, genesis))
+	b.Connect(a.address)
+
+	c := startTestNode(t, newTestChainFrom(t, genesis))
+	c.addrs.Add([]string{a.address}, time.Now())
+
+	deadline := time.Now().Add(10 * time.Second)
+	for c.peers.Get(b.address) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("c did not connect to the peer it heard of from a")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ka, ok := c.addrs.Get(a.address)
+	assert.True(t, ok)
+	assert.Equal(t, 1, ka.Successes)
+	assert.NotContains(t, c.KnownNodes(), c.address)
+}
+
+func TestEveryNodeRelaysTransactions(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+	bcA := newTestBlockchain(t, string(alice.GetAddress()))
+	genesis := bcA.mustGetBlock(bcA.tip)
+
+	a := startTestNode(t, bcA)
+	assert.NoError(t, a.processBlock(mineTestBlock(bcA, genesis, string(bob.GetAddress())), nil))
+
+	bcB := newTestChainFrom(t, genesis)
+	b := startTestNode(t, bcB)
+	c := startTestNode(t, newTestChainFrom(t, genesis))
+	b.Connect(a.address)
+	c.Connect(a.address)
+	waitForHeight(t, 1, b, c)
+
+	b.chainMu.RLock()
+	tx := NewUTXOTransaction(alice, string(bob.GetAddress()), 3, 1, &UTXOSet{bcB})
+	b.chainMu.RUnlock()
+	assert.NoError(t, submitTx(b.address, bcB, tx))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(c.MempoolTransactions()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Transaction did not reach c through a")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, tx.ID, c.MempoolTransactions()[0].ID)
+}
+
+func TestInboundPeersAreLimited(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+
+	cfg := testConfig()
+	cfg.MaxInbound = 1
+	a := runTestNode(t, NewNode(cfg, bc))
+	b := startTestNode(t, newTestChainFrom(t, bc.mustGetBlock(bc.tip)))
+	b.Connect(a.address)
+
+	conn, err := net.Dial(protocol, a.address)
+	assert.NoError(t, err)
+	p := newPeer(conn, a.address, false)
+	t.Cleanup(p.Close)
+	assert.NoError(t, p.handshake(version{nodeVersion, nodeServices, 0, "127.0.0.1:1", 1}))
+
+	go p.run(func(p *Peer, msg *message) {})
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("a took more inbound peers than allowed")
+	}
+	assert.Equal(t, 1, a.peers.Count())
+}
+
+func TestInboundPeersAreKnownByTheirConnection(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	a := startTestNode(t, bc)
+	b := startTestNode(t, newTestChainFrom(t, bc.mustGetBlock(bc.tip)))
+
+	// The peer claims to listen at b's address.
+	conn, err := net.Dial(protocol, a.address)
+	assert.NoError(t, err)
+	p := newPeer(conn, a.address, false)
+	t.Cleanup(p.Close)
+	assert.NoError(t, p.handshake(version{nodeVersion, nodeServices, 0, b.address, 1}))
+	go p.run(func(p *Peer, msg *message) {})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for a.peers.Get(conn.LocalAddr().String()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("a did not register the peer by its remote address")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, a.peers.Get(b.address))
+	assert.Contains(t, a.KnownNodes(), b.address, "The claimed address is still gossiped")
+
+	b.Connect(a.address)
+	for a.peers.Count() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("The claim kept b out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeerInfoIsOnlyForLocalSessions(t *testing.T) {
+	bc := newTestBlockchain(t, string(NewWallet().GetAddress()))
+	n := NewNode(Config{}, bc)
+
+	_, local := testPeerPair(t)
+	n.handleMessage(local, &message{"getpeerinfo", nil})
+	assert.Equal(t, "peerinfo", nextMessage(t, local).Command)
+
+	_, node := testPeerPair(t)
+	node.version.AddrFrom = "127.0.0.1:3001"
+	n.handleMessage(node, &message{"getpeerinfo", nil})
+	assert.Empty(t, node.outbound, "Nodes on this machine are not answered either")
+
+	conn, other := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	remote := newPeer(conn, "10.0.0.1:3000", true)
+	n.handleMessage(remote, &message{"getpeerinfo", nil})
+	assert.Empty(t, remote.outbound, "Remote peers do not learn about our peers")
+}
@@ -0,0 +1,46 @@
+package main
+
+// GetBlockSubsidy returns the newly issued coins a block at height may
+// claim. It halves every HalvingInterval blocks until it reaches zero.
+func GetBlockSubsidy(height int) int {
+	halvings := height / chainParams.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return chainParams.InitialSubsidy >> uint(halvings)
+}
+
+// ScheduledSupply returns the coins issued by the blocks up to and
+// including height, if every coinbase claims its full subsidy.
+func ScheduledSupply(height int) int {
+	supply := 0
+
+	for h := 0; h <= height; {
+		reward := GetBlockSubsidy(h)
+		if reward == 0 {
+			break
+		}
+
+		eraEnd := (h/chainParams.HalvingInterval+1)*chainParams.HalvingInterval - 1
+		if eraEnd > height {
+			eraEnd = height
+		}
+
+		supply += reward * (eraEnd - h + 1)
+		h = eraEnd + 1
+	}
+
+	return supply
+}
+
+// MaxSupply returns the total amount of coins that will ever be issued.
+func MaxSupply() int {
+	supply := 0
+
+	for h := 0; GetBlockSubsidy(h) > 0; h += chainParams.HalvingInterval {
+		supply += GetBlockSubsidy(h) * chainParams.HalvingInterval
+	}
+
+	return supply
+}
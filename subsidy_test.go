@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBlockSubsidy(t *testing.T) {
+	interval := chainParams.HalvingInterval
+
+	assert.Equal(t, chainParams.InitialSubsidy, GetBlockSubsidy(0))
+	assert.Equal(t, chainParams.InitialSubsidy, GetBlockSubsidy(interval-1))
+	assert.Equal(t, chainParams.InitialSubsidy/2, GetBlockSubsidy(interval))
+	assert.Equal(t, chainParams.InitialSubsidy/4, GetBlockSubsidy(2*interval))
+	assert.Equal(t, 0, GetBlockSubsidy(64*interval))
+}
+
+func TestScheduledSupply(t *testing.T) {
+	interval := chainParams.HalvingInterval
+	initial := chainParams.InitialSubsidy
+
+	assert.Equal(t, initial, ScheduledSupply(0))
+	assert.Equal(t, initial*interval, ScheduledSupply(interval-1))
+	assert.Equal(t, initial*interval+initial/2*2, ScheduledSupply(interval+1))
+	assert.Equal(t, MaxSupply(), ScheduledSupply(100*interval), "Issuance stops at the cap")
+}
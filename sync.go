@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const maxHeadersPerMsg = 2000
+const blockDownloadWindow = 64
+const maxBlocksInFlightPerPeer = 16
+
+var blockRequestTimeout = 20 * time.Second
+var syncTickInterval = time.Second
+
+// maxHeadersPerPeer bounds how many headers of blocks still to download a
+// peer may have us keep. Once it is reached the peer's further headers are
+// refused until its blocks have come in or the peer is gone.
+var maxHeadersPerPeer = 20000
+
+var errTooManyHeaders = errors.New("too many headers waiting for their blocks")
+
+type getheaders struct {
+	Locator [][]byte
+	Stop    []byte
+}
+
+type headers struct {
+	Headers []BlockHeader
+}
+
+type headerEntry struct {
+	header BlockHeader
+	work   *big.Int
+	peer   *Peer
+}
+
+type blockRequest struct {
+	peer     *Peer
+	deadline time.Time
+}
+
+// HeaderSync follows the best header chain announced by peers and
+// schedules the download of the blocks it is still missing. Bodies are
+// fetched in parallel from several peers, but only within a window of the
+// lowest missing heights so that they can be connected as they arrive.
+type HeaderSync struct {
+	bc *Blockchain
+
+	mu       sync.Mutex
+	headers  map[string]*headerEntry
+	bestHash []byte
+	bestWork *big.Int
+	queue    [][]byte
+	inFlight map[string]*blockRequest
+	timedOut map[string]map[*Peer]bool
+	peerTips map[*Peer]*headerEntry
+
+	// announced counts the headers each peer added, and throttled holds
+	// the peers that hit maxHeadersPerPeer.
+	announced map[*Peer]int
+	throttled map[*Peer]bool
+}
+
+func NewHeaderSync(bc *Blockchain) *HeaderSync {
+	return &HeaderSync{
+		bc:       bc,
+		headers:  make(map[string]*headerEntry),
+		bestWork: big.NewInt(0),
+		inFlight: make(map[string]*blockRequest),
+		timedOut: make(map[string]map[*Peer]bool),
+		peerTips: make(map[*Peer]*headerEntry),
+
+		announced: make(map[*Peer]int),
+		throttled: make(map[*Peer]bool),
+	}
+}
+
+// AddHeaders checks that hdrs, as sent by p, have valid proof-of-work,
+// follow the difficulty and timestamp rules and hang, one after the other,
+// off a known header or block, and remembers them. Headers before the
+// first invalid one are kept, and p is expected to serve the blocks of all
+// of them. Once p has maxHeadersPerPeer headers waiting, the rest are
+// refused with errTooManyHeaders.
+func (hs *HeaderSync) AddHeaders(p *Peer, hdrs []BlockHeader) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	changed := false
+	defer func() {
+		if changed {
+			hs.rebuildQueue()
+		}
+	}()
+
+	for i := range hdrs {
+		h := hdrs[i]
+		id := hex.EncodeToString(h.Hash)
+		if e := hs.headers[id]; e != nil {
+			hs.setPeerTip(p, e)
+			continue
+		}
+		if hs.bc.HasBlock(h.Hash) {
+			continue
+		}
+
+		if hs.announced[p] >= maxHeadersPerPeer {
+			hs.throttled[p] = true
+			return errTooManyHeaders
+		}
+
+		err := CheckHeader(&h)
+		if err != nil {
+			return err
+		}
+
+		parent, parentWork, ok := hs.lookup(h.PrevBlockHash)
+		if !ok {
+			return reject(RejectOrphan, "header %x does not connect to a known block", h.Hash)
+		}
+		err = hs.checkContext(&h, parent)
+		if err != nil {
+			return err
+		}
+
+		work := blockWork(h.Bits)
+		work.Add(work, parentWork)
+		e := &headerEntry{h, work, p}
+		hs.headers[id] = e
+		hs.announced[p]++
+		hs.setPeerTip(p, e)
+
+		if work.Cmp(hs.bestWork) > 0 {
+			hs.bestHash = h.Hash
+			hs.bestWork = work
+			changed = true
+		}
+	}
+
+	return nil
+}
+
+func (hs *HeaderSync) setPeerTip(p *Peer, e *headerEntry) {
+	if tip := hs.peerTips[p]; tip == nil || e.header.Height > tip.header.Height {
+		hs.peerTips[p] = e
+	}
+}
+
+// peerHas lists the pending headers each peer has announced, directly or
+// through a descendant.
+func (hs *HeaderSync) peerHas() map[*Peer]map[string]bool {
+	has := make(map[*Peer]map[string]bool)
+	for p, tip := range hs.peerTips {
+		has[p] = make(map[string]bool)
+		for e := tip; e != nil; e = hs.headers[hex.EncodeToString(e.header.PrevBlockHash)] {
+			has[p][hex.EncodeToString(e.header.Hash)] = true
+		}
+	}
+
+	return has
+}
+
+// checkContext checks h against its parent the way ValidateBlock checks a
+// block: its height, difficulty bits and timestamp.
+func (hs *HeaderSync) checkContext(h *BlockHeader, parent *Block) error {
+	if h.Height != parent.Height+1 {
+		return reject(RejectBadHeight, "header %x has height %d, expected %d", h.Hash, h.Height, parent.Height+1)
+	}
+	if bits := nextBits(parent, hs.parent); h.Bits != bits {
+		return reject(RejectBadDiffBits, "header %x has difficulty %d, expected %d", h.Hash, h.Bits, bits)
+	}
+
+	mtp := medianTimePast(parent, hs.parent)
+	if h.Timestamp <= mtp {
+		return reject(RejectTimeTooOld, "header %x timestamp %d is not after median time past %d", h.Hash, h.Timestamp, mtp)
+	}
+	maxTime := hs.bc.now().Unix() + chainParams.MaxFutureBlockTime
+	if h.Timestamp > maxTime {
+		return reject(RejectTimeTooNew, "header %x timestamp %d is more than %ds in the future", h.Hash, h.Timestamp, chainParams.MaxFutureBlockTime)
+	}
+
+	return nil
+}
+
+// lookup returns a known header or block, without transactions, and its
+// cumulative work.
+func (hs *HeaderSync) lookup(hash []byte) (*Block, *big.Int, bool) {
+	if e := hs.headers[hex.EncodeToString(hash)]; e != nil {
+		return e.header.Block(), e.work, true
+	}
+
+	block, err := hs.bc.GetBlock(hash)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return &block, hs.bc.GetChainWork(hash), true
+}
+
+// parent walks back the header chain into the stored blocks.
+func (hs *HeaderSync) parent(block *Block) *Block {
+	if e := hs.headers[hex.EncodeToString(block.PrevBlockHash)]; e != nil {
+		return e.header.Block()
+	}
+
+	return hs.bc.mustGetBlock(block.PrevBlockHash)
+}
+
+// forget drops the header with the given id and whatever was pending for
+// its block.
+func (hs *HeaderSync) forget(id string) {
+	if e := hs.headers[id]; e != nil {
+		if _, ok := hs.announced[e.peer]; ok {
+			hs.announced[e.peer]--
+		}
+	}
+	delete(hs.headers, id)
+	delete(hs.inFlight, id)
+	delete(hs.timedOut, id)
+}
+
+// rebuildQueue lists the blocks of the best header chain that are not
+// stored yet, lowest first.
+func (hs *HeaderSync) rebuildQueue() {
+	var queue [][]byte
+
+	hash := hs.bestHash
+	for {
+		e := hs.headers[hex.EncodeToString(hash)]
+		if e == nil || hs.bc.HasBlock(hash) {
+			break
+		}
+		queue = append(queue, hash)
+		hash = e.header.PrevBlockHash
+	}
+
+	for i, j := 0, len(queue)-1; i < j; i, j = i+1, j-1 {
+		queue[i], queue[j] = queue[j], queue[i]
+	}
+	hs.queue = queue
+}
+
+// Has reports whether hash is a header whose block is being synced.
+func (hs *HeaderSync) Has(hash []byte) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	return hs.headers[hex.EncodeToString(hash)] != nil
+}
+
+// Locator describes the best known chain: the best header chain if it has
+// more work than the active chain ending at tip, otherwise the latter.
+func (hs *HeaderSync) Locator(tip []byte, tipWork *big.Int) [][]byte {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	start := tip
+	if hs.bestHash != nil && hs.bestWork.Cmp(tipWork) > 0 {
+		start = hs.bestHash
+	}
+
+	return buildLocator(start, func(hash []byte) []byte {
+		if e := hs.headers[hex.EncodeToString(hash)]; e != nil {
+			return e.header.PrevBlockHash
+		}
+
+		block, err := hs.bc.GetBlock(hash)
+		if err != nil {
+			return nil
+		}
+
+		return block.PrevBlockHash
+	})
+}
+
+// NextRequests assigns missing blocks within the download window to the
+// peers that announced them, least busy first, skipping peers that already
+// timed out on a block. It returns the hashes each peer should be asked for.
+func (hs *HeaderSync) NextRequests(peers []*Peer) map[*Peer][][]byte {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for len(hs.queue) > 0 && hs.bc.HasBlock(hs.queue[0]) {
+		hs.forget(hex.EncodeToString(hs.queue[0]))
+		hs.queue = hs.queue[1:]
+	}
+
+	has := hs.peerHas()
+	load := make(map[*Peer]int)
+	for _, req := range hs.inFlight {
+		load[req.peer]++
+	}
+
+	window := hs.queue
+	if len(window) > blockDownloadWindow {
+		window = window[:blockDownloadWindow]
+	}
+
+	requests := make(map[*Peer][][]byte)
+	for _, hash := range window {
+		id := hex.EncodeToString(hash)
+		if hs.inFlight[id] != nil {
+			continue
+		}
+
+		best := hs.pickPeer(id, peers, has, load)
+		if best == nil && hs.allTimedOut(id, peers, has) {
+			// Every peer that has the block failed us on it; start over
+			// with all of them.
+			delete(hs.timedOut, id)
+			best = hs.pickPeer(id, peers, has, load)
+		}
+		if best == nil {
+			continue
+		}
+
+		hs.inFlight[id] = &blockRequest{best, time.Now().Add(blockRequestTimeout)}
+		load[best]++
+		requests[best] = append(requests[best], hash)
+	}
+
+	return requests
+}
+
+// pickPeer returns the least busy peer that has announced block id and has
+// not timed out on it.
+func (hs *HeaderSync) pickPeer(id string, peers []*Peer, has map[*Peer]map[string]bool, load map[*Peer]int) *Peer {
+	var best *Peer
+	for _, p := range peers {
+		if !has[p][id] || load[p] >= maxBlocksInFlightPerPeer || hs.timedOut[id][p] {
+			continue
+		}
+		if best == nil || load[p] < load[best] {
+			best = p
+		}
+	}
+
+	return best
+}
+
+func (hs *HeaderSync) allTimedOut(id string, peers []*Peer, has map[*Peer]map[string]bool) bool {
+	if len(hs.timedOut[id]) == 0 {
+		return false
+	}
+	for _, p := range peers {
+		if has[p][id] && !hs.timedOut[id][p] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Received marks the block as no longer in flight and reports whether it
+// was downloaded as part of the sync.
+func (hs *HeaderSync) Received(hash []byte) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	id := hex.EncodeToString(hash)
+	delete(hs.inFlight, id)
+	delete(hs.timedOut, id)
+
+	return hs.headers[id] != nil
+}
+
+// Expire gives up on requests that have not been answered by now so that
+// the blocks are asked from other peers. It returns the peers that stalled.
+func (hs *HeaderSync) Expire(now time.Time) []*Peer {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	var stalled []*Peer
+	for id, req := range hs.inFlight {
+		if now.Before(req.deadline) {
+			continue
+		}
+
+		if hs.timedOut[id] == nil {
+			hs.timedOut[id] = make(map[*Peer]bool)
+		}
+		hs.timedOut[id][req.peer] = true
+		delete(hs.inFlight, id)
+		stalled = append(stalled, req.peer)
+	}
+
+	return stalled
+}
+
+// Resume returns the throttled peers that are down to half of
+// maxHeadersPerPeer headers waiting, and may be asked for more.
+func (hs *HeaderSync) Resume() []*Peer {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	var peers []*Peer
+	for p := range hs.throttled {
+		if hs.announced[p] <= maxHeadersPerPeer/2 {
+			delete(hs.throttled, p)
+			peers = append(peers, p)
+		}
+	}
+
+	return peers
+}
+
+// DropPeer releases the blocks that were requested from p and forgets the
+// headers that no other peer has announced and that are not on the best
+// header chain.
+func (hs *HeaderSync) DropPeer(p *Peer) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for id, req := range hs.inFlight {
+		if req.peer == p {
+			delete(hs.inFlight, id)
+		}
+	}
+	for _, peers := range hs.timedOut {
+		delete(peers, p)
+	}
+	delete(hs.peerTips, p)
+	delete(hs.announced, p)
+	delete(hs.throttled, p)
+
+	keep := make(map[string]bool)
+	tips := [][]byte{hs.bestHash}
+	for _, tip := range hs.peerTips {
+		tips = append(tips, tip.header.Hash)
+	}
+	for _, hash := range tips {
+		for e := hs.headers[hex.EncodeToString(hash)]; e != nil; e = hs.headers[hex.EncodeToString(e.header.PrevBlockHash)] {
+			id := hex.EncodeToString(e.header.Hash)
+			if keep[id] {
+				break
+			}
+			keep[id] = true
+		}
+	}
+	for id := range hs.headers {
+		if !keep[id] {
+			hs.forget(id)
+		}
+	}
+}
+
+// Invalidate forgets the header of a block that failed validation along
+// with every header built on it, and falls back to the best chain left.
+func (hs *HeaderSync) Invalidate(hash []byte) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	bad := map[string]bool{hex.EncodeToString(hash): true}
+	for found := true; found; {
+		found = false
+		for id, e := range hs.headers {
+			if !bad[id] && bad[hex.EncodeToString(e.header.PrevBlockHash)] {
+				bad[id] = true
+				found = true
+			}
+		}
+	}
+
+	hs.bestHash = nil
+	hs.bestWork = big.NewInt(0)
+	for id := range bad {
+		hs.forget(id)
+	}
+	for p, tip := range hs.peerTips {
+		if bad[hex.EncodeToString(tip.header.Hash)] {
+			delete(hs.peerTips, p)
+		}
+	}
+	for _, e := range hs.headers {
+		if e.work.Cmp(hs.bestWork) > 0 {
+			hs.bestHash = e.header.Hash
+			hs.bestWork = e.work
+		}
+	}
+
+	hs.rebuildQueue()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testHeaderChain mines n blocks on a fresh chain and returns them along
+// with a second chain that only has their genesis.
+func testHeaderChain(t *testing.T, n int) ([]*Block, *Blockchain) {
+	address := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, address)
+	prev := bc.mustGetBlock(bc.tip)
+	empty := newTestChainFrom(t, prev)
+
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		block := mineTestBlock(bc, prev, address)
+		_, _, err := bc.AddBlock(block)
+		assert.NoError(t, err)
+		blocks = append(blocks, block)
+		prev = block
+	}
+
+	return blocks, empty
+}
+
+func testHeaders(blocks []*Block) []BlockHeader {
+	var hdrs []BlockHeader
+	for _, b := range blocks {
+		hdrs = append(hdrs, b.Header())
+	}
+
+	return hdrs
+}
+
+// remineTestHeader finds a new nonce for h after its fields were changed.
+func remineTestHeader(h BlockHeader) BlockHeader {
+	b := h.Block()
+	b.Mine(context.Background())
+
+	return b.Header()
+}
+
+func TestHeaderSyncRejectsBadHeaders(t *testing.T) {
+	blocks, bc := testHeaderChain(t, 3)
+	hs := NewHeaderSync(bc)
+	p := newPeer(nil, "peer", false)
+
+	err := hs.AddHeaders(p, testHeaders(blocks[1:]))
+	assertRejected(t, RejectOrphan, err)
+
+	h := blocks[0].Header()
+	h.Nonce++
+	err = hs.AddHeaders(p, []BlockHeader{h})
+	assertRejected(t, RejectBadHash, err)
+
+	h = blocks[0].Header()
+	h.Height = 5
+	err = hs.AddHeaders(p, []BlockHeader{h})
+	assertRejected(t, RejectBadHeight, err)
+
+	h = blocks[0].Header()
+	h.Bits++
+	err = hs.AddHeaders(p, []BlockHeader{remineTestHeader(h)})
+	assertRejected(t, RejectBadDiffBits, err)
+
+	h = blocks[0].Header()
+	h.Timestamp = bc.mustGetBlock(bc.tip).Timestamp
+	err = hs.AddHeaders(p, []BlockHeader{remineTestHeader(h)})
+	assertRejected(t, RejectTimeTooOld, err)
+
+	assert.NoError(t, hs.AddHeaders(p, testHeaders(blocks)))
+	assert.True(t, hs.Has(blocks[2].Hash))
+}
+
+func TestHeaderSyncLimitsHeadersPerPeer(t *testing.T) {
+	defer func(limit int) { maxHeadersPerPeer = limit }(maxHeadersPerPeer)
+	maxHeadersPerPeer = 2
+
+	blocks, bc := testHeaderChain(t, 3)
+	hs := NewHeaderSync(bc)
+	p1 := newPeer(nil, "p1", false)
+	p2 := newPeer(nil, "p2", false)
+
+	err := hs.AddHeaders(p1, testHeaders(blocks))
+	assert.Equal(t, errTooManyHeaders, err)
+	assert.True(t, hs.Has(blocks[1].Hash))
+	assert.False(t, hs.Has(blocks[2].Hash))
+	assert.Empty(t, hs.Resume(), "Nothing has been downloaded yet")
+
+	assert.NoError(t, hs.AddHeaders(p2, testHeaders(blocks[2:])), "The limit is per peer")
+	assert.True(t, hs.Has(blocks[2].Hash))
+
+	for _, b := range blocks[:2] {
+		_, _, err := bc.AddBlock(b)
+		assert.NoError(t, err)
+	}
+	hs.NextRequests(nil)
+	assert.Equal(t, []*Peer{p1}, hs.Resume())
+
+	hs.DropPeer(p2)
+	assert.True(t, hs.Has(blocks[2].Hash), "Headers on the best chain are kept")
+}
+
+func TestHeaderSyncForgetsHeadersOfDroppedPeers(t *testing.T) {
+	blocks, bc := testHeaderChain(t, 2)
+	hs := NewHeaderSync(bc)
+	p := newPeer(nil, "p", false)
+	assert.NoError(t, hs.AddHeaders(p, testHeaders(blocks)))
+
+	// A side branch with less work than the best header chain.
+	h := blocks[0].Header()
+	h.Timestamp++
+	side := remineTestHeader(h)
+	other := newPeer(nil, "other", false)
+	assert.NoError(t, hs.AddHeaders(other, []BlockHeader{side}))
+	assert.True(t, hs.Has(side.Hash))
+
+	hs.DropPeer(other)
+	assert.False(t, hs.Has(side.Hash))
+	assert.True(t, hs.Has(blocks[1].Hash))
+}
+
+func TestHeaderSyncSpreadsAndReassignsRequests(t *testing.T) {
+	blocks, bc := testHeaderChain(t, 4)
+	hs := NewHeaderSync(bc)
+	p1 := newPeer(nil, "p1", false)
+	p2 := newPeer(nil, "p2", false)
+	lagging := newPeer(nil, "p3", false)
+
+	assert.NoError(t, hs.AddHeaders(p1, testHeaders(blocks)))
+	assert.NoError(t, hs.AddHeaders(p2, testHeaders(blocks)))
+	assert.NoError(t, hs.AddHeaders(lagging, testHeaders(blocks[:1])))
+
+	peers := []*Peer{p1, p2, lagging}
+	first := hs.NextRequests(peers)
+	assert.Len(t, first[p1], 2)
+	assert.Len(t, first[p2], 2)
+	assert.Empty(t, first[lagging], "Blocks are only asked from peers that announced them")
+	assert.Empty(t, hs.NextRequests(peers), "Nothing is requested twice")
+
+	stalled := hs.Expire(time.Now().Add(blockRequestTimeout + time.Second))
+	assert.Len(t, stalled, 4)
+
+	second := hs.NextRequests(peers)
+	assert.Len(t, second[p1], 2)
+	assert.ElementsMatch(t, first[p2], second[p1], "Timed out blocks move to another peer")
+	assert.ElementsMatch(t, first[p1], second[p2])
+
+	_, _, err := bc.AddBlock(blocks[0])
+	assert.NoError(t, err)
+	assert.True(t, hs.Received(blocks[0].Hash))
+	hs.NextRequests(peers)
+	assert.False(t, hs.Has(blocks[0].Hash), "Stored blocks leave the sync")
+
+	var released [][]byte
+	for _, hash := range second[p1] {
+		if !bc.HasBlock(hash) {
+			released = append(released, hash)
+		}
+	}
+	hs.DropPeer(p1)
+	third := hs.NextRequests([]*Peer{p2})
+	assert.ElementsMatch(t, released, third[p2], "A dropped peer's requests are reassigned")
+}
@@ -7,15 +7,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"math/big"
 	"strings"
 )
 
-const subsidy = 10
-
 type Transaction struct {
 	ID   []byte
 	Vin  []TXInput
@@ -26,6 +23,18 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
+// Replaceable reports whether tx opted into replace-by-fee through the
+// sequence number of one of its inputs.
+func (tx Transaction) Replaceable() bool {
+	for _, vin := range tx.Vin {
+		if vin.Sequence == SequenceReplaceable {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
 
@@ -49,32 +58,99 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// UnsignedHash is the hash a transaction ID commits to. The ID is set
+// before inputs are signed, so unlocking scripts are left out, except for
+// the coinbase data that tells coinbases apart.
+func (tx *Transaction) UnsignedHash() []byte {
+	if tx.IsCoinbase() {
+		return tx.Hash()
+	}
+
+	txCopy := tx.TrimmedCopy()
+
+	return txCopy.Hash()
+}
+
+// sigHash is the digest the signature of input inID commits to: tx without
+// unlocking scripts, the locking script of prevOut standing in for that of
+// the input.
+func (tx *Transaction) sigHash(inID int, prevOut TXOutput) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].ScriptSig = prevOut.ScriptPubKey
+
+	return txCopy.Hash()
+}
+
+// SignWithOutputs signs the inputs of tx given the outputs they spend,
+// prevOuts[i] being the output referenced by tx.Vin[i], which have to be
+// P2PKH outputs of privKey.
+func (tx *Transaction) SignWithOutputs(privKey ecdsa.PrivateKey, prevOuts []TXOutput) {
 	if tx.IsCoinbase() {
 		return
 	}
 
-	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+	pubKey := encodePubKey(&privKey.PublicKey)
+	legacy := encodeLegacyPubKey(&privKey.PublicKey)
+	for inID := range tx.Vin {
+		// Outputs paid to a wallet created before keys were padded are
+		// locked with the hash of its unpadded key.
+		key := pubKey
+		if hash, ok := prevOuts[inID].ScriptPubKey.PubKeyHash(); ok && bytes.Equal(hash, HashPubKey(legacy)) {
+			key = legacy
 		}
+
+		signature := signHash(privKey, tx.sigHash(inID, prevOuts[inID]))
+		tx.Vin[inID].ScriptSig = P2PKHUnlockingScript(signature, key)
 	}
+}
 
-	txCopy := tx.TrimmedCopy()
+// signHash signs hash with privKey. Both halves of the signature are
+// padded to the same width so verifySignature can split it down the
+// middle.
+func signHash(privKey ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
 
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+	return signature
+}
+
+// verifySignature reports whether signature is a valid signature of hash
+// by pubKey. The unpadded key of a wallet created before keys were padded
+// is shorter, and does not tell which coordinate lost its leading zeros,
+// so each way of splitting it is tried.
+func verifySignature(hash, signature, pubKey []byte) bool {
+	if len(signature) != 64 || len(pubKey) > 64 {
+		return false
+	}
 
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(signature[:32])
+	s.SetBytes(signature[32:])
 
-		r, s, _ := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		signature := append(r.Bytes(), s.Bytes()...)
+	xLen := 0
+	if len(pubKey) > 32 {
+		xLen = len(pubKey) - 32
+	}
+	for ; xLen <= 32 && xLen <= len(pubKey); xLen++ {
+		x := big.Int{}
+		y := big.Int{}
+		x.SetBytes(pubKey[:xLen])
+		y.SetBytes(pubKey[xLen:])
 
-		tx.Vin[inID].Signature = signature
-		txCopy.Vin[inID].PubKey = nil
+		rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+		if ecdsa.Verify(&rawPubKey, hash, &r, &s) {
+			return true
+		}
 	}
+
+	return false
 }
 
 func (tx Transaction) String() string {
@@ -87,14 +163,14 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.Txid))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Vout))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       ScriptSig: %s", input.ScriptSig))
+		lines = append(lines, fmt.Sprintf("       Sequence:  %d", input.Sequence))
 	}
 
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", output.ScriptPubKey))
 	}
 
 	return strings.Join(lines, "\n")
@@ -105,11 +181,11 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, vin.Sequence})
 	}
 
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.ScriptPubKey})
 	}
 
 	txCopy := Transaction{tx.ID, inputs, outputs}
@@ -117,62 +193,54 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	return txCopy
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
-	}
+// VerifyWithOutputs checks the signatures of tx given the outputs it
+// spends, prevOuts[i] being the output referenced by tx.Vin[i].
+func (tx *Transaction) VerifyWithOutputs(prevOuts []TXOutput) bool {
+	return tx.VerifyScripts(prevOuts) == nil
+}
 
-	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
-		}
+// VerifyScripts runs the unlocking script of every input of tx against
+// the locking script of the output it spends, prevOuts[i] being the output
+// referenced by tx.Vin[i], and returns why the first one that fails does.
+func (tx *Transaction) VerifyScripts(prevOuts []TXOutput) error {
+	if tx.IsCoinbase() {
+		return nil
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+		hash := tx.sigHash(inID, prevOuts[inID])
+		checkSig := func(signature, pubKey []byte) bool {
+			return verifySignature(hash, signature, pubKey)
+		}
 
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false
+		err := VerifyScript(vin.ScriptSig, prevOuts[inID].ScriptPubKey, checkSig)
+		if err != nil {
+			return fmt.Errorf("input %d: %s", inID, err)
 		}
-		txCopy.Vin[inID].PubKey = nil
 	}
 
-	return true
+	return nil
 }
 
+// TXOutput is an amount locked by a script, usually a P2PKHScript.
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value        int
+	ScriptPubKey Script
 }
 
+// Lock makes the output payable to address.
 func (out *TXOutput) Lock(address []byte) {
 	pubKeyHash := Base58Decode(address)
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	out.ScriptPubKey = P2PKHScript(pubKeyHash)
 }
 
+// IsLockedWithKey reports whether the output pays to pubKeyHash with the
+// standard P2PKH script.
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	lockingHash, ok := out.ScriptPubKey.PubKeyHash()
+
+	return ok && bytes.Equal(lockingHash, pubKeyHash)
 }
 
 func NewTXOutput(value int, address string) *TXOutput {
@@ -182,8 +250,17 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
+// TXOutputs holds the unspent outputs of a transaction keyed by their
+// index in Vout, so partially spent transactions keep their positions,
+// along with the height and coinbase-ness of the transaction.
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs  map[int]TXOutput
+	Height   int
+	Coinbase bool
+}
+
+func NewTXOutputs(height int, coinbase bool) TXOutputs {
+	return TXOutputs{make(map[int]TXOutput), height, coinbase}
 }
 
 func (outs TXOutputs) Serialize() []byte {
@@ -206,24 +283,39 @@ func DeserializeOutputs(data []byte) TXOutputs {
 	if err != nil {
 		log.Panic(err)
 	}
+	if outputs.Outputs == nil {
+		outputs.Outputs = make(map[int]TXOutput)
+	}
 
 	return outputs
 }
 
+// SequenceReplaceable is the sequence number of an input whose transaction
+// may be replaced while pending by one paying a higher fee. The default,
+// zero, makes the transaction final.
+const SequenceReplaceable uint32 = 1
+
+// TXInput spends output Vout of transaction Txid. ScriptSig is the script
+// unlocking it; for a coinbase it holds arbitrary data instead.
 type TXInput struct {
 	Txid      []byte
 	Vout      int
-	Signature []byte
-	PubKey    []byte
+	ScriptSig Script
+	Sequence  uint32
 }
 
+// UsesKey reports whether the input is unlocked with the standard P2PKH
+// script by a key hashing to pubKeyHash.
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
+	pubKey, ok := in.ScriptSig.P2PKHPubKey()
 
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	return ok && bytes.Equal(HashPubKey(pubKey), pubKeyHash)
 }
 
-func NewCoinbaseTX(to, data string) *Transaction {
+// NewCoinbaseTX creates the transaction paying the block subsidy for height
+// and the fees collected from the other transactions of the block to
+// address to.
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 20)
 		rand.Read(randData)
@@ -231,49 +323,118 @@ func NewCoinbaseTX(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
+	txin := TXInput{[]byte{}, -1, Script(data), 0}
+	txout := NewTXOutput(GetBlockSubsidy(height)+fees, to)
 	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction creates a transaction sending amount to address to.
+// The fee is left unspent by the outputs, to be collected by the miner.
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
+	return NewTransaction(wallet, to, amount, fee, UTXOSet, nil, false)
+}
+
+// NewTransaction is NewUTXOTransaction for a wallet with transactions
+// still pending: it can spend their outputs, such as its own change, and
+// leaves alone the outputs they already spend. A replaceable transaction
+// can have its fee bumped with NewFeeBump until it is mined.
+func NewTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet, pending []*Transaction, replaceable bool) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
+	var prevOuts []TXOutput
 
 	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	acc, coins := UTXOSet.FindCoins(pubKeyHash, amount+fee, pending)
 
-	if acc < amount {
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 
-	// Build a list of inputs
-	for txid, outs := range validOutputs {
-		txID, _ := hex.DecodeString(txid)
+	sequence := uint32(0)
+	if replaceable {
+		sequence = SequenceReplaceable
+	}
 
-		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
-		}
+	// Build a list of inputs
+	for _, coin := range coins {
+		inputs = append(inputs, TXInput{coin.Txid, coin.Vout, nil, sequence})
+		prevOuts = append(prevOuts, coin.Output)
 	}
 
 	// Build a list of outputs
 	from := fmt.Sprintf("%s", wallet.GetAddress())
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from)) // a change
 	}
 
 	tx := Transaction{nil, inputs, outputs}
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
+	tx.SignWithOutputs(wallet.PrivateKey, prevOuts)
 
 	return &tx
 }
 
+// NewFeeBump returns a replacement for the pending transaction tx of wallet
+// that pays fee instead, taking the difference from the change. prevOuts
+// are the outputs tx spends, prevOuts[i] being the one of tx.Vin[i].
+func NewFeeBump(wallet *Wallet, tx *Transaction, prevOuts []TXOutput, fee int) (*Transaction, error) {
+	if !tx.Replaceable() {
+		return nil, fmt.Errorf("transaction %x does not signal replace-by-fee", tx.ID)
+	}
+
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	inputValue := 0
+	for i := range tx.Vin {
+		if !prevOuts[i].IsLockedWithKey(pubKeyHash) {
+			return nil, fmt.Errorf("input %d of transaction %x is not spent by this wallet", i, tx.ID)
+		}
+		inputValue += prevOuts[i].Value
+	}
+
+	outputValue := 0
+	change := -1
+	for i, out := range tx.Vout {
+		outputValue += out.Value
+		if out.IsLockedWithKey(pubKeyHash) {
+			change = i
+		}
+	}
+
+	oldFee := inputValue - outputValue
+	if fee <= oldFee {
+		return nil, fmt.Errorf("transaction %x already pays %d", tx.ID, oldFee)
+	}
+	if change < 0 || tx.Vout[change].Value < fee-oldFee {
+		return nil, fmt.Errorf("transaction %x has too little change to pay %d more", tx.ID, fee-oldFee)
+	}
+
+	var inputs []TXInput
+	for _, vin := range tx.Vin {
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, vin.Sequence})
+	}
+
+	var outputs []TXOutput
+	for i, out := range tx.Vout {
+		if i == change {
+			out.Value -= fee - oldFee
+			if out.Value == 0 {
+				continue
+			}
+		}
+		outputs = append(outputs, out)
+	}
+
+	bump := Transaction{nil, inputs, outputs}
+	bump.ID = bump.Hash()
+	bump.SignWithOutputs(wallet.PrivateKey, prevOuts)
+
+	return &bump, nil
+}
+
 func DeserializeTransaction(data []byte) Transaction {
 	var transaction Transaction
 
@@ -1,54 +1,68 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/hex"
+	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"log"
 )
 
 const utxoPrefix = "chainstate"
+const undoPrefix = "undo"
 
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
+// Coin is an output a wallet can spend.
+type Coin struct {
+	Txid   []byte
+	Vout   int
+	Output TXOutput
+}
+
+// FindCoins gathers mature outputs locked with pubKeyHash until they are
+// worth amount, and returns their value. The outputs of the pending
+// transactions can be spent too, after the confirmed ones, while the
+// outputs these already spend are left out.
+func (u UTXOSet) FindCoins(pubKeyHash []byte, amount int, pending []*Transaction) (int, []Coin) {
+	spent := make(map[string]bool)
+	for _, tx := range pending {
+		for _, vin := range tx.Vin {
+			spent[outpoint(vin.Txid, vin.Vout)] = true
+		}
+	}
+
+	var coins []Coin
 	accumulated := 0
-	db := u.Blockchain.db
+	add := func(txid []byte, vout int, out TXOutput) {
+		if accumulated >= amount || spent[outpoint(txid, vout)] || !out.IsLockedWithKey(pubKeyHash) {
+			return
+		}
+		accumulated += out.Value
+		coins = append(coins, Coin{txid, vout, out})
+	}
 
-	db.View(func(txn *badger.Txn) error {
-		//b := tx.Bucket([]byte(utxoBucket))
+	spendHeight := u.Blockchain.GetBestHeight() + 1
+	u.Blockchain.db.View(func(txn *badger.Txn) error {
 		p := []byte(utxoPrefix)
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
-		//c := b.Cursor()
-
-		//for k, v := c.First(); k != nil; k, v = c.Next() {
-		//	txID := hex.EncodeToString(k)
-		//	outs := DeserializeOutputs(v)
-		//
-		//	for outIdx, out := range outs.Outputs {
-		//		if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-		//			accumulated += out.Value
-		//			unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-		//		}
-		//	}
-		//}
 
 		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
 			item := it.Item()
-			k := item.Key()
+			txID := item.KeyCopy(nil)[len(p):]
 			_ = item.Value(func(v []byte) error {
-				txID := hex.EncodeToString(k)
 				outs := DeserializeOutputs(v)
+				entry := UTXOEntry{Height: outs.Height, Coinbase: outs.Coinbase}
+				if !entry.IsMature(spendHeight) {
+					return nil
+				}
 
 				for outIdx, out := range outs.Outputs {
-					if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-						accumulated += out.Value
-						unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-					}
+					add(txID, outIdx, out)
 				}
 				return nil
 			})
@@ -57,7 +71,13 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		return nil
 	})
 
-	return accumulated, unspentOutputs
+	for _, tx := range pending {
+		for outIdx, out := range tx.Vout {
+			add(tx.ID, outIdx, out)
+		}
+	}
+
+	return accumulated, coins
 }
 
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
@@ -103,6 +123,82 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+// UTXOEntry is an unspent output together with the height and
+// coinbase-ness of the transaction that created it.
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// IsMature reports whether the entry can be spent by a transaction in a
+// block at spendHeight. Coinbase outputs need CoinbaseMaturity
+// confirmations, except for the genesis one which can never be reorganized
+// away.
+func (e UTXOEntry) IsMature(spendHeight int) bool {
+	if !e.Coinbase || e.Height == 0 {
+		return true
+	}
+
+	return spendHeight-e.Height >= chainParams.CoinbaseMaturity
+}
+
+// FindOutput returns the unspent output vout of transaction txid.
+func (u UTXOSet) FindOutput(txid []byte, vout int) (UTXOEntry, bool) {
+	var entry UTXOEntry
+	found := false
+
+	u.Blockchain.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte(utxoPrefix), txid...))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			outs := DeserializeOutputs(v)
+			entry.Height = outs.Height
+			entry.Coinbase = outs.Coinbase
+			entry.Output, found = outs.Outputs[vout]
+			return nil
+		})
+	})
+
+	return entry, found
+}
+
+// TotalValue returns the sum of all unspent outputs, i.e. the coins in
+// circulation.
+func (u UTXOSet) TotalValue() int {
+	db := u.Blockchain.db
+	total := 0
+
+	err := db.View(func(txn *badger.Txn) error {
+		p := []byte(utxoPrefix)
+		opts := badger.DefaultIteratorOptions
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				for _, out := range DeserializeOutputs(v).Outputs {
+					total += out.Value
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return total
+}
+
 func (u UTXOSet) CountTransactions() int {
 	db := u.Blockchain.db
 	counter := 0
@@ -165,49 +261,144 @@ func (u UTXOSet) Reindex() {
 	})
 }
 
+// Update applies block to the set and stores the outputs it spends as undo
+// data, so Disconnect can revert it without rescanning the chain.
 func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.db
-
-	db.Update(func(txn *badger.Txn) error {
-		//b := tx.Bucket([]byte(utxoBucket))
-		p := []byte(utxoPrefix)
-
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					item, _ := txn.Get(vin.Txid)
-
-					var outsBytes []byte
-					_ = item.Value(func(val []byte) error {
-						outsBytes = val
-						return nil
-					})
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+	err := u.Blockchain.db.Update(func(txn *badger.Txn) error {
+		return u.update(txn, block)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-					if len(updatedOuts.Outputs) == 0 {
-						txn.Delete(append(p, vin.Txid...))
-					} else {
-						txn.Set(append(p, vin.Txid...), updatedOuts.Serialize())
-					}
+// update makes the changes of Update within txn.
+func (u UTXOSet) update(txn *badger.Txn, block *Block) error {
+	//b := tx.Bucket([]byte(utxoBucket))
+	p := []byte(utxoPrefix)
+	undo := BlockUndo{}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, vin := range tx.Vin {
+				key := append(p, vin.Txid...)
+				item, err := txn.Get(key)
+				if err != nil {
+					return fmt.Errorf("output %x:%d is not in the UTXO set", vin.Txid, vin.Vout)
+				}
 
+				outsBytes, _ := item.ValueCopy(nil)
+				outs := DeserializeOutputs(outsBytes)
+				out, ok := outs.Outputs[vin.Vout]
+				if !ok {
+					return fmt.Errorf("output %x:%d is not in the UTXO set", vin.Txid, vin.Vout)
 				}
-			}
+				undo.Spent = append(undo.Spent, SpentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.Coinbase})
+				delete(outs.Outputs, vin.Vout)
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				if len(outs.Outputs) == 0 {
+					txn.Delete(key)
+				} else {
+					txn.Set(key, outs.Serialize())
+				}
 			}
+		}
 
-			txn.Set(append(p, tx.ID...), newOutputs.Serialize())
+		newOutputs := NewTXOutputs(block.Height, tx.IsCoinbase())
+		for outIdx, out := range tx.Vout {
+			newOutputs.Outputs[outIdx] = out
 		}
 
-		return nil
+		txn.Set(append(p, tx.ID...), newOutputs.Serialize())
+	}
+
+	return txn.Set(append([]byte(undoPrefix), block.Hash...), undo.Serialize())
+}
+
+// Disconnect reverts the changes Update made for block using its undo data:
+// outputs created by its transactions are removed and the outputs they
+// spent are restored at their original positions.
+func (u UTXOSet) Disconnect(block *Block) {
+	err := u.Blockchain.db.Update(func(txn *badger.Txn) error {
+		return u.disconnect(txn, block)
 	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// disconnect makes the changes of Disconnect within txn.
+func (u UTXOSet) disconnect(txn *badger.Txn, block *Block) error {
+	p := []byte(utxoPrefix)
+	undoKey := append([]byte(undoPrefix), block.Hash...)
+
+	item, err := txn.Get(undoKey)
+	if err != nil {
+		return fmt.Errorf("no undo data for block %x", block.Hash)
+	}
+	undoBytes, _ := item.ValueCopy(nil)
+	undo := DeserializeBlockUndo(undoBytes)
+
+	created := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		txn.Delete(append(p, tx.ID...))
+		created[hex.EncodeToString(tx.ID)] = true
+	}
+
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		spent := undo.Spent[i]
+		if created[hex.EncodeToString(spent.Txid)] {
+			continue
+		}
+
+		key := append(p, spent.Txid...)
+		outs := NewTXOutputs(spent.Height, spent.Coinbase)
+		if item, err := txn.Get(key); err == nil {
+			outsBytes, _ := item.ValueCopy(nil)
+			outs = DeserializeOutputs(outsBytes)
+		}
+		outs.Outputs[spent.Vout] = spent.Output
+
+		txn.Set(key, outs.Serialize())
+	}
+
+	return txn.Delete(undoKey)
+}
+
+// SpentOutput is an output consumed by a block, kept with its position so
+// the block can be disconnected later.
+type SpentOutput struct {
+	Txid     []byte
+	Vout     int
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(undo)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return undo
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUTXOSetDisconnectRestoresSpentOutputs(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	UTXOSet := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+
+	pay := NewUTXOTransaction(alice, string(bob.GetAddress()), 4, 0, &UTXOSet)
+	block1 := mineTestBlock(bc, genesis, string(alice.GetAddress()), pay)
+	bc.AddBlock(block1)
+
+	// Spend only the change output, leaving the payment at index 0 unspent.
+	spendChange := NewUTXOTransaction(alice, string(bob.GetAddress()), chainParams.InitialSubsidy-4, 0, &UTXOSet)
+	before := UTXOSet.CountTransactions()
+	block2 := mineTestBlock(bc, block1, string(bob.GetAddress()), spendChange)
+	UTXOSet.Update(block2)
+
+	UTXOSet.Disconnect(block2)
+
+	assert.Equal(t, before, UTXOSet.CountTransactions())
+	assert.Equal(t, 2*chainParams.InitialSubsidy-4, testBalance(UTXOSet, alice))
+	assert.Equal(t, 4, testBalance(UTXOSet, bob))
+
+	err := bc.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(append([]byte(undoPrefix), block2.Hash...))
+		return err
+	})
+	assert.Equal(t, badger.ErrKeyNotFound, err, "Undo data is dropped once applied")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// RejectReason identifies which consensus rule a block or transaction broke.
+type RejectReason string
+
+const (
+	RejectNoTransactions      RejectReason = "bad-blk-length"
+	RejectBadHash             RejectReason = "bad-blk-hash"
+	RejectHighHash            RejectReason = "high-hash"
+	RejectBadDiffBits         RejectReason = "bad-diffbits"
+	RejectTimeTooOld          RejectReason = "time-too-old"
+	RejectTimeTooNew          RejectReason = "time-too-new"
+	RejectBadMerkleRoot       RejectReason = "bad-txnmrklroot"
+	RejectOrphan              RejectReason = "prev-blk-not-found"
+	RejectBadHeight           RejectReason = "bad-height"
+	RejectNoCoinbase          RejectReason = "bad-cb-missing"
+	RejectMultipleCoinbase    RejectReason = "bad-cb-multiple"
+	RejectBadCoinbaseAmount   RejectReason = "bad-cb-amount"
+	RejectDuplicateTx         RejectReason = "bad-txns-duplicate"
+	RejectBadTxID             RejectReason = "bad-txns-id"
+	RejectEmptyTx             RejectReason = "bad-txns-empty"
+	RejectNegativeOutput      RejectReason = "bad-txns-vout-negative"
+	RejectOutputTooLarge      RejectReason = "bad-txns-vout-toolarge"
+	RejectOutputTotalTooLarge RejectReason = "bad-txns-txouttotal-toolarge"
+	RejectInputsOutOfRange    RejectReason = "bad-txns-inputvalues-outofrange"
+	RejectDoubleSpend         RejectReason = "bad-txns-inputs-duplicate"
+	RejectMissingInputs       RejectReason = "bad-txns-inputs-missingorspent"
+	RejectInputsBelowOutputs  RejectReason = "bad-txns-in-belowout"
+	RejectBadSignature        RejectReason = "bad-txns-signature"
+	RejectPrematureSpend      RejectReason = "bad-txns-premature-spend-of-coinbase"
+	RejectLooseCoinbase       RejectReason = "coinbase"
+	RejectAlreadyKnown        RejectReason = "txn-already-known"
+	RejectMempoolConflict     RejectReason = "txn-mempool-conflict"
+	RejectMempoolFull         RejectReason = "mempool-full"
+	RejectTooLongChain        RejectReason = "too-long-mempool-chain"
+	RejectInsufficientFee     RejectReason = "insufficient-fee"
+	RejectTooManyReplacements RejectReason = "too-many-replacements"
+)
+
+// maxMoney is more than will ever be in circulation. No output, and no sum
+// of values, may exceed it, so adding values that passed the check cannot
+// overflow.
+const maxMoney = 21000000
+
+type ValidationError struct {
+	Reason  RejectReason
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+func reject(reason RejectReason, format string, a ...interface{}) error {
+	return &ValidationError{reason, fmt.Sprintf(format, a...)}
+}
+
+// CheckHeader checks the proof-of-work of a header on its own, before the
+// rest of its block is known.
+func CheckHeader(h *BlockHeader) error {
+	if h.Bits < chainParams.MinBits || h.Bits > chainParams.MaxBits {
+		return reject(RejectBadDiffBits, "header %x has difficulty %d out of range", h.Hash, h.Bits)
+	}
+
+	pow := NewProofOfWork(h.Block())
+	if !bytes.Equal(pow.Hash(), h.Hash) {
+		return reject(RejectBadHash, "header hash %x does not match its fields", h.Hash)
+	}
+	if !pow.Validate(h.Bits) {
+		return reject(RejectHighHash, "header %x does not meet its difficulty", h.Hash)
+	}
+
+	return nil
+}
+
+// CheckBlock runs the checks that need nothing but the block itself.
+func CheckBlock(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return reject(RejectNoTransactions, "block %x has no transactions", block.Hash)
+	}
+	if block.Bits < chainParams.MinBits || block.Bits > chainParams.MaxBits {
+		return reject(RejectBadDiffBits, "block %x has difficulty %d out of range", block.Hash, block.Bits)
+	}
+
+	pow := NewProofOfWork(block)
+	if !bytes.Equal(pow.Hash(), block.Hash) {
+		return reject(RejectBadHash, "block hash %x does not match its header", block.Hash)
+	}
+	if !pow.Validate(block.Bits) {
+		return reject(RejectHighHash, "block %x does not meet its difficulty", block.Hash)
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return reject(RejectBadMerkleRoot, "block %x merkle root mismatch", block.Hash)
+	}
+
+	if !block.Transactions[0].IsCoinbase() {
+		return reject(RejectNoCoinbase, "first transaction of block %x is not a coinbase", block.Hash)
+	}
+
+	seenTxs := make(map[string]bool)
+	spent := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return reject(RejectMultipleCoinbase, "block %x has more than one coinbase", block.Hash)
+		}
+
+		err := CheckTransaction(tx)
+		if err != nil {
+			return err
+		}
+
+		txID := hex.EncodeToString(tx.ID)
+		if seenTxs[txID] {
+			return reject(RejectDuplicateTx, "transaction %s appears twice", txID)
+		}
+		seenTxs[txID] = true
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+			if spent[outpoint] {
+				return reject(RejectDoubleSpend, "output %s is spent twice in block %x", outpoint, block.Hash)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	return nil
+}
+
+// CheckTransaction runs the checks that need nothing but the transaction itself.
+func CheckTransaction(tx *Transaction) error {
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return reject(RejectEmptyTx, "transaction %x has no inputs or outputs", tx.ID)
+	}
+	if !bytes.Equal(tx.ID, tx.UnsignedHash()) {
+		return reject(RejectBadTxID, "transaction %x has a wrong ID", tx.ID)
+	}
+
+	total := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return reject(RejectNegativeOutput, "transaction %x has a negative output", tx.ID)
+		}
+		if out.Value > maxMoney {
+			return reject(RejectOutputTooLarge, "transaction %x has an output of %d", tx.ID, out.Value)
+		}
+		if total > maxMoney-out.Value {
+			return reject(RejectOutputTotalTooLarge, "outputs of transaction %x add up to more than %d", tx.ID, maxMoney)
+		}
+		total += out.Value
+	}
+
+	return nil
+}
+
+// ValidateBlock checks block on its own and against its parent. Its
+// transactions are checked against the UTXO set only when the block gets
+// connected, because that depends on the branch it is connected to.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	err := CheckBlock(block)
+	if err != nil {
+		return err
+	}
+
+	if len(block.PrevBlockHash) == 0 {
+		return reject(RejectOrphan, "block %x has no parent", block.Hash)
+	}
+
+	parent, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return reject(RejectOrphan, "parent %x of block %x is unknown", block.PrevBlockHash, block.Hash)
+	}
+
+	if block.Height != parent.Height+1 {
+		return reject(RejectBadHeight, "block %x has height %d, expected %d", block.Hash, block.Height, parent.Height+1)
+	}
+	if block.Bits != bc.NextBits(&parent) {
+		return reject(RejectBadDiffBits, "block %x has wrong difficulty bits %d", block.Hash, block.Bits)
+	}
+
+	mtp := bc.MedianTimePast(&parent)
+	if block.Timestamp <= mtp {
+		return reject(RejectTimeTooOld, "block %x timestamp %d is not after median time past %d", block.Hash, block.Timestamp, mtp)
+	}
+	maxTime := bc.now().Unix() + chainParams.MaxFutureBlockTime
+	if block.Timestamp > maxTime {
+		return reject(RejectTimeTooNew, "block %x timestamp %d is more than %ds in the future", block.Hash, block.Timestamp, chainParams.MaxFutureBlockTime)
+	}
+
+	return nil
+}
+
+// CheckBlockInputs validates the transactions of block against the UTXO
+// set, which has to be at the block's parent.
+func (u UTXOSet) CheckBlockInputs(block *Block) error {
+	created := make(map[string]UTXOEntry)
+	coinbaseValue := 0
+	fees := 0
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			for _, out := range tx.Vout {
+				if out.Value < 0 || out.Value > maxMoney || coinbaseValue > maxMoney-out.Value {
+					return reject(RejectOutputTotalTooLarge, "coinbase of block %x pays more than %d", block.Hash, maxMoney)
+				}
+				coinbaseValue += out.Value
+			}
+		} else {
+			fee, err := u.checkTransactionInputs(tx, block.Height, created)
+			if err != nil {
+				return err
+			}
+			if fees > maxMoney-fee {
+				return reject(RejectInputsOutOfRange, "fees of block %x add up to more than %d", block.Hash, maxMoney)
+			}
+			fees += fee
+		}
+
+		for outIdx, out := range tx.Vout {
+			created[fmt.Sprintf("%x:%d", tx.ID, outIdx)] = UTXOEntry{out, block.Height, tx.IsCoinbase()}
+		}
+	}
+
+	limit := GetBlockSubsidy(block.Height) + fees
+	if coinbaseValue > limit {
+		return reject(RejectBadCoinbaseAmount, "coinbase of block %x pays %d, limit is %d", block.Hash, coinbaseValue, limit)
+	}
+
+	return nil
+}
+
+// checkTransactionInputs makes sure every input of tx spends an existing
+// unspent output, is signed by its owner and that tx does not create more
+// value than it spends. It returns the fee, the value left unspent by the
+// outputs. spendHeight is the height of the block tx is included in.
+// Outputs not yet in the UTXO set can be passed in pending, keyed by
+// "txid:vout".
+func (u UTXOSet) checkTransactionInputs(tx *Transaction, spendHeight int, pending map[string]UTXOEntry) (int, error) {
+	var prevOuts []TXOutput
+	inputValue := 0
+
+	for _, vin := range tx.Vin {
+		entry, ok := pending[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)]
+		if !ok {
+			entry, ok = u.FindOutput(vin.Txid, vin.Vout)
+		}
+		if !ok {
+			return 0, reject(RejectMissingInputs, "input %x:%d of transaction %x is missing or spent", vin.Txid, vin.Vout, tx.ID)
+		}
+		if !entry.IsMature(spendHeight) {
+			return 0, reject(RejectPrematureSpend, "input %x:%d of transaction %x spends an immature coinbase", vin.Txid, vin.Vout, tx.ID)
+		}
+
+		value := entry.Output.Value
+		if value < 0 || value > maxMoney || inputValue > maxMoney-value {
+			return 0, reject(RejectInputsOutOfRange, "inputs of transaction %x add up to more than %d", tx.ID, maxMoney)
+		}
+		prevOuts = append(prevOuts, entry.Output)
+		inputValue += value
+	}
+
+	outputValue := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > maxMoney || outputValue > maxMoney-out.Value {
+			return 0, reject(RejectOutputTotalTooLarge, "outputs of transaction %x add up to more than %d", tx.ID, maxMoney)
+		}
+		outputValue += out.Value
+	}
+	if inputValue < outputValue {
+		return 0, reject(RejectInputsBelowOutputs, "transaction %x spends %d but creates %d", tx.ID, inputValue, outputValue)
+	}
+
+	err := tx.VerifyScripts(prevOuts)
+	if err != nil {
+		return 0, reject(RejectBadSignature, "transaction %x is not unlocked: %s", tx.ID, err)
+	}
+
+	return inputValue - outputValue, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertRejected(t *testing.T, reason RejectReason, err error) {
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, reason, err.(*ValidationError).Reason)
+	}
+}
+
+func remineTestBlock(block *Block) *Block {
+	block.MerkleRoot = block.HashTransactions()
+	block.Mine(context.Background())
+
+	return block
+}
+
+// signTestTransaction signs the inputs of tx with key, whoever the outputs
+// they spend in u belong to.
+func signTestTransaction(u UTXOSet, tx *Transaction, key ecdsa.PrivateKey) {
+	var prevOuts []TXOutput
+	for _, vin := range tx.Vin {
+		entry, _ := u.FindOutput(vin.Txid, vin.Vout)
+		prevOuts = append(prevOuts, entry.Output)
+	}
+
+	tx.SignWithOutputs(key, prevOuts)
+}
+
+func TestAddBlockRejectsInvalidBlocks(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+	bc := newTestBlockchain(t, string(alice.GetAddress()))
+	UTXOSet := UTXOSet{bc}
+	genesis := bc.mustGetBlock(bc.tip)
+	miner := string(bob.GetAddress())
+
+	block := mineTestBlock(bc, genesis, miner)
+	block.Transactions[0].Vout[0].Value = chainParams.InitialSubsidy + 1
+	block.Transactions[0].ID = block.Transactions[0].Hash()
+	_, _, err := bc.AddBlock(remineTestBlock(block))
+	assertRejected(t, RejectBadCoinbaseAmount, err)
+
+	for reason, values := range map[RejectReason][]int{
+		RejectOutputTooLarge:      {math.MaxInt64, 10},
+		RejectOutputTotalTooLarge: {maxMoney, 1},
+	} {
+		block = mineTestBlock(bc, genesis, miner)
+		coinbase := block.Transactions[0]
+		coinbase.Vout = []TXOutput{coinbase.Vout[0], coinbase.Vout[0]}
+		coinbase.Vout[0].Value, coinbase.Vout[1].Value = values[0], values[1]
+		coinbase.ID = coinbase.Hash()
+		_, _, err = bc.AddBlock(remineTestBlock(block))
+		assertRejected(t, reason, err)
+	}
+
+	block = mineTestBlock(bc, genesis, miner)
+	block.Transactions = append(block.Transactions, NewCoinbaseTX(miner, "", 1, 0))
+	_, _, err = bc.AddBlock(block)
+	assertRejected(t, RejectBadMerkleRoot, err)
+
+	block = mineTestBlock(bc, genesis, miner)
+	block.Bits++
+	_, _, err = bc.AddBlock(remineTestBlock(block))
+	assertRejected(t, RejectBadDiffBits, err)
+
+	for _, bits := range []int{-(1 << 38), 300} {
+		block = mineTestBlock(bc, genesis, miner)
+		block.Bits = bits
+		_, _, err = bc.AddBlock(block)
+		assertRejected(t, RejectBadDiffBits, err)
+	}
+
+	block = mineTestBlock(bc, genesis, miner)
+	block.PrevBlockHash = block.Hash
+	_, _, err = bc.AddBlock(remineTestBlock(block))
+	assertRejected(t, RejectOrphan, err)
+
+	pay := NewUTXOTransaction(alice, miner, 3, 0, &UTXOSet)
+	block = mineTestBlock(bc, genesis, miner, pay, pay)
+	_, _, err = bc.AddBlock(block)
+	assertRejected(t, RejectDuplicateTx, err)
+
+	theft := NewUTXOTransaction(alice, miner, chainParams.InitialSubsidy, 0, &UTXOSet)
+	signTestTransaction(UTXOSet, theft, bob.PrivateKey)
+	block = mineTestBlock(bc, genesis, miner, theft)
+	_, _, err = bc.AddBlock(block)
+	assertRejected(t, RejectBadSignature, err)
+
+	assert.Equal(t, genesis.Hash, bc.tip)
+	assert.False(t, bc.HasBlock(block.Hash), "Rejected blocks are not stored")
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	carol := NewWallet()
+	bob := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, bob)
+	chainParams.CoinbaseMaturity = 3
+	UTXOSet := UTXOSet{bc}
+
+	block := mineTestBlock(bc, bc.mustGetBlock(bc.tip), string(carol.GetAddress()))
+	_, _, err := bc.AddBlock(block)
+	assert.NoError(t, err)
+	coinbase := block.Transactions[0]
+
+	spend := &Transaction{nil, []TXInput{{coinbase.ID, 0, nil, 0}}, []TXOutput{*NewTXOutput(5, bob)}}
+	spend.ID = spend.Hash()
+	signTestTransaction(UTXOSet, spend, carol.PrivateKey)
+
+	_, _, err = bc.AddBlock(mineTestBlock(bc, block, bob, spend))
+	assertRejected(t, RejectPrematureSpend, err)
+	acc, _ := UTXOSet.FindCoins(HashPubKey(carol.PublicKey), 5, nil)
+	assert.Equal(t, 0, acc, "Immature coinbase is not spendable")
+
+	for i := 0; i < 2; i++ {
+		block = mineTestBlock(bc, block, bob)
+		bc.AddBlock(block)
+	}
+	acc, _ = UTXOSet.FindCoins(HashPubKey(carol.PublicKey), 5, nil)
+	assert.Equal(t, chainParams.InitialSubsidy, acc)
+
+	_, _, err = bc.AddBlock(mineTestBlock(bc, block, bob, spend))
+	assert.NoError(t, err)
+}
+
+func TestBlockTimestampRules(t *testing.T) {
+	miner := string(NewWallet().GetAddress())
+	bc := newTestBlockchain(t, miner)
+	prev := bc.mustGetBlock(bc.tip)
+	clock := time.Unix(prev.Timestamp, 0)
+	bc.now = func() time.Time { return clock }
+
+	for i := 0; i < 5; i++ {
+		clock = clock.Add(time.Minute)
+		block := mineTestBlock(bc, prev, miner)
+		_, _, err := bc.AddBlock(block)
+		assert.NoError(t, err)
+		prev = block
+	}
+	mtp := bc.MedianTimePast(prev)
+
+	block := mineTestBlock(bc, prev, miner)
+	block.Timestamp = mtp
+	_, _, err := bc.AddBlock(remineTestBlock(block))
+	assertRejected(t, RejectTimeTooOld, err)
+
+	block = mineTestBlock(bc, prev, miner)
+	block.Timestamp = clock.Unix() + chainParams.MaxFutureBlockTime + 1
+	_, _, err = bc.AddBlock(remineTestBlock(block))
+	assertRejected(t, RejectTimeTooNew, err)
+
+	clock = clock.Add(time.Second)
+	_, _, err = bc.AddBlock(remineTestBlock(block))
+	assert.NoError(t, err, "Block is accepted once the clock catches up")
+}
@@ -72,9 +72,23 @@ func checksum(payload []byte) []byte {
 func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	private, _ := ecdsa.GenerateKey(curve, rand.Reader)
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
 
-	return *private, pubKey
+	return *private, encodePubKey(&private.PublicKey)
+}
+
+// encodePubKey returns the coordinates of pub, each padded to 32 bytes.
+func encodePubKey(pub *ecdsa.PublicKey) []byte {
+	pubKey := make([]byte, 64)
+	pub.X.FillBytes(pubKey[:32])
+	pub.Y.FillBytes(pubKey[32:])
+
+	return pubKey
+}
+
+// encodeLegacyPubKey returns the coordinates of pub without padding, the
+// way wallets encoded their key before encodePubKey.
+func encodeLegacyPubKey(pub *ecdsa.PublicKey) []byte {
+	return append(pub.X.Bytes(), pub.Y.Bytes()...)
 }
 
 type Wallets struct {